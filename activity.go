@@ -0,0 +1,79 @@
+package exporter
+
+import (
+	"time"
+
+	"github.com/dnesting/sense/realtime"
+)
+
+// activity tracks which devices are on, as we learn about it from a stream.
+// A device is on while DeviceStates says it's active, or while RealtimeUpdate
+// says it's drawing power, since only Sense-integrated devices report states.
+type activity struct {
+	mode    map[string]bool // active, as of the last DeviceStates; nil until one arrives
+	powered map[string]bool // drawing power, as of the last RealtimeUpdate; nil until one arrives
+	on      map[string]bool
+	last    time.Time // zero while disconnected
+}
+
+// update accumulates into t how long each device was on until now, then
+// applies msg, counting devices that turned on as a result.  Devices already
+// on when we first hear from either source aren't counted, since they
+// turned on before we were watching.
+func (a *activity) update(msg realtime.Message, now time.Time, t *energyTotals) {
+	if !a.last.IsZero() {
+		if dt := now.Sub(a.last); dt <= maxEnergyGap {
+			for id := range a.on {
+				t.ActiveSeconds[id] += dt.Seconds()
+			}
+		}
+	}
+	a.last = now
+
+	var initial bool
+	switch msg := msg.(type) {
+	case *realtime.RealtimeUpdate:
+		initial = a.powered == nil
+		a.powered = make(map[string]bool)
+		for _, d := range msg.Devices {
+			if d.W > 0 {
+				a.powered[d.ID] = true
+			}
+		}
+	case *realtime.DeviceStates:
+		initial = a.mode == nil
+		a.mode = make(map[string]bool)
+		for _, ds := range msg.States {
+			if ds.Mode == "active" {
+				a.mode[ds.DeviceID] = true
+			}
+		}
+	default:
+		return
+	}
+
+	on := make(map[string]bool)
+	for id := range a.mode {
+		on[id] = true
+	}
+	for id := range a.powered {
+		on[id] = true
+	}
+	for id := range on {
+		if !initial && !a.on[id] {
+			t.Activations[id]++
+		}
+		if _, ok := t.ActiveSeconds[id]; !ok {
+			// So that we report the device from the start.
+			t.ActiveSeconds[id] = 0
+		}
+	}
+	a.on = on
+}
+
+// disconnected notes that we've stopped hearing from the monitor, so we
+// don't know what devices did in the meantime.  The first messages after we
+// reconnect are treated like the first ones we ever received.
+func (a *activity) disconnected() {
+	*a = activity{}
+}
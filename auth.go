@@ -0,0 +1,177 @@
+package exporter
+
+import (
+	"context"
+	"log"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	minReauthBackoff = 10 * time.Second
+	maxReauthBackoff = 30 * time.Minute
+)
+
+var (
+	authFailuresDesc = prometheus.NewDesc("sense_account_auth_failures_total",
+		"Number of times Sense has rejected our credentials for an account",
+		[]string{"account"}, nil)
+	authenticatedDesc = prometheus.NewDesc("sense_account_authenticated",
+		"Whether we believe we're currently authenticated to an account",
+		[]string{"account"}, nil)
+)
+
+// Reauthenticator logs in again to the account used by cl, returning a client
+// to use in its place.
+type Reauthenticator func(ctx context.Context, cl Client) (Client, error)
+
+// SetReauthenticator arranges for fn to be called when Sense rejects our
+// credentials for an account.  Until fn succeeds, it is retried with backoff.
+func (e *Exporter) SetReauthenticator(fn Reauthenticator) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.reauth = fn
+}
+
+// accountState tracks whether we're authenticated to an account.
+type accountState struct {
+	failures        int
+	unauthenticated bool
+	reauthing       bool
+	backoff         time.Duration
+}
+
+// authResult records the outcome of a call to Sense made using cl, and
+// arranges to log in again if Sense rejected our credentials.
+func (e *Exporter) authResult(cl Client, err error) {
+	if err != nil && !isAuthError(err) {
+		// Says nothing about our credentials either way.
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !slices.Contains(e.clients, cl) {
+		// Already replaced.
+		return
+	}
+	st := e.account(cl.GetAccountID())
+	if err == nil {
+		st.unauthenticated = false
+		return
+	}
+	st.failures++
+	st.unauthenticated = true
+	log.Printf("account %d: credentials rejected: %v", cl.GetAccountID(), err)
+	if e.reauth != nil && !st.reauthing {
+		st.reauthing = true
+		go e.reauthenticate(cl, st)
+	}
+}
+
+// account returns the state for the given account.  e.mu must be held.
+func (e *Exporter) account(id int) *accountState {
+	st, ok := e.accounts[id]
+	if !ok {
+		st = &accountState{}
+		e.accounts[id] = st
+	}
+	return st
+}
+
+// reauthenticate logs in again to the account used by cl, retrying with
+// backoff until it succeeds, and then replaces cl with the new client.
+func (e *Exporter) reauthenticate(cl Client, st *accountState) {
+	e.mu.Lock()
+	fn := e.reauth
+	ctx := e.ctx
+	e.mu.Unlock()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	for {
+		log.Printf("account %d: logging in again", cl.GetAccountID())
+		newCl, err := fn(ctx, cl)
+		e.mu.Lock()
+		if err == nil {
+			st.reauthing = false
+			st.unauthenticated = false
+			st.backoff = 0
+			e.replaceClient(cl, newCl)
+			e.mu.Unlock()
+			log.Printf("account %d: logged in again", cl.GetAccountID())
+			return
+		}
+		st.failures++
+		st.backoff = min(max(st.backoff*2, minReauthBackoff), maxReauthBackoff)
+		backoff := st.backoff
+		e.mu.Unlock()
+
+		log.Printf("account %d: logging in again: %v (retrying in %s)", cl.GetAccountID(), err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// replaceClient replaces old with cl in our list of clients.  e.mu must be
+// held.
+func (e *Exporter) replaceClient(old, cl Client) {
+	// Requests in progress may be using the old slice, so make a new one.
+	clients := slices.Clone(e.clients)
+	for i := range clients {
+		if clients[i] == old {
+			clients[i] = cl
+		}
+	}
+	e.clients = clients
+	if e.ctx != nil {
+		e.syncStreams()
+	}
+	e.rebuild()
+}
+
+// authCollector reports on the state of each account.
+type authCollector struct {
+	e *Exporter
+}
+
+func (c authCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- authFailuresDesc
+	ch <- authenticatedDesc
+}
+
+func (c authCollector) Collect(ch chan<- prometheus.Metric) {
+	c.e.mu.Lock()
+	defer c.e.mu.Unlock()
+	seen := make(map[int]bool)
+	for _, cl := range c.e.clients {
+		id := cl.GetAccountID()
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		st := c.e.account(id)
+		authenticated := 1.0
+		if st.unauthenticated {
+			authenticated = 0
+		}
+		ch <- prometheus.MustNewConstMetric(
+			authFailuresDesc,
+			prometheus.CounterValue,
+			float64(st.failures),
+			strconv.Itoa(id),
+		)
+		ch <- prometheus.MustNewConstMetric(
+			authenticatedDesc,
+			prometheus.GaugeValue,
+			authenticated,
+			strconv.Itoa(id),
+		)
+	}
+}
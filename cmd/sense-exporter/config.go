@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+
+	exporter "github.com/dnesting/sense-exporter"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultSinkInterval is how often sinks are written if no interval is given.
+const defaultSinkInterval = time.Minute
+
+// configFile is the structure of the YAML config file.  Exporter settings live
+// under the "exporter" key, so the same file can also hold the "accounts"
+// section used by -sense-config.
+type configFile struct {
+	Exporter config `yaml:"exporter"`
+
+	// Everything else belongs to sensecli.
+	Other map[string]yaml.Node `yaml:",inline"`
+}
+
+// config holds exporter settings.  Settings given here take precedence over
+// the corresponding flags.
+type config struct {
+	Timeout    time.Duration `yaml:"timeout"`
+	Stream     *bool         `yaml:"stream"`
+	StateFile  string        `yaml:"state-file"`
+	TokenCache string        `yaml:"token-cache"`
+	Sinks      []sinkConfig  `yaml:"sinks"`
+
+	// MonitorRefresh is how often to log in again to look for monitors
+	// added to or removed from each account.
+	MonitorRefresh time.Duration `yaml:"monitor-refresh"`
+
+	exporter.Options `yaml:",inline"`
+}
+
+// sinkConfig describes an additional destination for metrics, beyond the
+// HTTP endpoint.
+type sinkConfig struct {
+	// Textfile writes metrics in the Prometheus text format to the given
+	// file, e.g. for use with node_exporter's textfile collector.
+	Textfile string        `yaml:"textfile"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// loadConfig reads exporter settings from the named file.
+func loadConfig(filename string) (*config, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readConfig(filename, f)
+}
+
+func readConfig(filename string, r io.Reader) (*config, error) {
+	var cf configFile
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	if err := dec.Decode(&cf); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	cfg := &cf.Exporter
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return cfg, nil
+}
+
+// applyFlags fills in any settings not given in the config file from flags.
+func (c *config) applyFlags() {
+	if c.Timeout == 0 {
+		c.Timeout = *flagTimeout
+	}
+	if c.Stream == nil {
+		c.Stream = flagStream
+	}
+	if c.StateFile == "" {
+		c.StateFile = *flagState
+	}
+	if c.TokenCache == "" {
+		c.TokenCache = *flagTokens
+	}
+	if c.MonitorRefresh == 0 {
+		c.MonitorRefresh = *flagRefresh
+	}
+	if *flagSlim {
+		c.DeviceIDLabelsOnly = true
+	}
+}
+
+// validate checks the config for errors, naming the offending key in each.
+func (c *config) validate() error {
+	var errs []error
+	if c.Timeout < 0 {
+		errs = append(errs, errors.New("exporter.timeout: must not be negative"))
+	}
+	if c.MonitorRefresh < 0 {
+		errs = append(errs, errors.New("exporter.monitor-refresh: must not be negative"))
+	}
+	for i := range c.Sinks {
+		s := &c.Sinks[i]
+		if s.Textfile == "" {
+			errs = append(errs, fmt.Errorf("exporter.sinks[%d]: sink must specify textfile", i))
+		}
+		if s.Interval < 0 {
+			errs = append(errs, fmt.Errorf("exporter.sinks[%d].interval: must not be negative", i))
+		} else if s.Interval == 0 {
+			s.Interval = defaultSinkInterval
+		}
+	}
+	if err := c.Options.Validate(); err != nil {
+		for _, err := range unjoin(err) {
+			errs = append(errs, fmt.Errorf("exporter.%w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// restartRequired returns the keys of the settings in c that differ from
+// those in running, which is in effect, but which only take effect on
+// restart.  Both must have had applyFlags called.
+func (c *config) restartRequired(running *config) []string {
+	var keys []string
+	if *c.Stream != *running.Stream {
+		keys = append(keys, "stream")
+	}
+	if c.StateFile != running.StateFile {
+		keys = append(keys, "state-file")
+	}
+	if c.TokenCache != running.TokenCache {
+		keys = append(keys, "token-cache")
+	}
+	if !slices.Equal(c.Sinks, running.Sinks) {
+		keys = append(keys, "sinks")
+	}
+	if c.MonitorRefresh != running.MonitorRefresh {
+		keys = append(keys, "monitor-refresh")
+	}
+	return keys
+}
+
+// unjoin undoes errors.Join.
+func unjoin(err error) []error {
+	if j, ok := err.(interface{ Unwrap() []error }); ok {
+		return j.Unwrap()
+	}
+	return []error{err}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr []string // substrings of the error, if any
+		check   func(t *testing.T, cfg *config)
+	}{
+		{
+			name: "empty",
+			yaml: "",
+			check: func(t *testing.T, cfg *config) {
+				if cfg.Timeout != 0 || cfg.Stream != nil || len(cfg.Sinks) != 0 {
+					t.Errorf("Expected zero config, got %+v", cfg)
+				}
+			},
+		},
+		{
+			name: "settings",
+			yaml: `
+exporter:
+  timeout: 30s
+  stream: false
+  device-id-labels-only: true
+  max-concurrency: 2
+  monitors:
+    123:
+      name: home
+`,
+			check: func(t *testing.T, cfg *config) {
+				if cfg.Timeout != 30*time.Second {
+					t.Errorf("Expected timeout 30s, got %s", cfg.Timeout)
+				}
+				if cfg.Stream == nil || *cfg.Stream {
+					t.Errorf("Expected stream false, got %v", cfg.Stream)
+				}
+				if !cfg.DeviceIDLabelsOnly || cfg.MaxConcurrency != 2 || cfg.Monitors[123].Name != "home" {
+					t.Errorf("Expected exporter options to be read, got %+v", cfg.Options)
+				}
+			},
+		},
+		{
+			name: "other sections belong to sensecli",
+			yaml: `
+accounts:
+- email: someone@example.com
+exporter:
+  timeout: 5s
+`,
+			check: func(t *testing.T, cfg *config) {
+				if cfg.Timeout != 5*time.Second {
+					t.Errorf("Expected timeout 5s, got %s", cfg.Timeout)
+				}
+			},
+		},
+		{
+			name: "sink interval defaults",
+			yaml: `
+exporter:
+  sinks:
+  - textfile: /tmp/sense.prom
+`,
+			check: func(t *testing.T, cfg *config) {
+				if len(cfg.Sinks) != 1 || cfg.Sinks[0].Interval != defaultSinkInterval {
+					t.Errorf("Expected one sink with interval %s, got %+v", defaultSinkInterval, cfg.Sinks)
+				}
+			},
+		},
+		{
+			name:    "unknown key",
+			yaml:    "exporter:\n  bogus: 1\n",
+			wantErr: []string{"test.yaml:", "bogus"},
+		},
+		{
+			name:    "unknown option",
+			yaml:    "exporter:\n  devices:\n    bogus: 1\n",
+			wantErr: []string{"test.yaml:", "bogus"},
+		},
+		{
+			name: "invalid settings",
+			yaml: `
+exporter:
+  timeout: -1s
+  monitor-refresh: -1s
+  sinks:
+  - interval: -1s
+  devices:
+    exclude:
+    - {}
+  metrics:
+    bogus: false
+`,
+			wantErr: []string{
+				"test.yaml: ",
+				"exporter.timeout: must not be negative",
+				"exporter.monitor-refresh: must not be negative",
+				"exporter.sinks[0]: sink must specify textfile",
+				"exporter.sinks[0].interval: must not be negative",
+				"exporter.devices.exclude[0]: rule must specify",
+				"exporter.metrics.bogus: unknown metric family",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := readConfig("test.yaml", strings.NewReader(tt.yaml))
+			if len(tt.wantErr) > 0 {
+				if err == nil {
+					t.Fatal("Expected an error")
+				}
+				for _, want := range tt.wantErr {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("Expected error to contain %q, got: %v", want, err)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, cfg)
+		})
+	}
+}
+
+func TestConfigApplyFlags(t *testing.T) {
+	cfg, err := readConfig("test.yaml", strings.NewReader("exporter:\n  timeout: 30s\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.applyFlags()
+	if cfg.Timeout != 30*time.Second {
+		t.Errorf("Expected the config file's timeout to win, got %s", cfg.Timeout)
+	}
+	if cfg.Stream == nil || *cfg.Stream != *flagStream {
+		t.Errorf("Expected stream from -stream (%v), got %v", *flagStream, cfg.Stream)
+	}
+	if cfg.MonitorRefresh != *flagRefresh {
+		t.Errorf("Expected monitor-refresh from -monitor-refresh (%s), got %s", *flagRefresh, cfg.MonitorRefresh)
+	}
+}
+
+func TestConfigRestartRequired(t *testing.T) {
+	read := func(yaml string) *config {
+		t.Helper()
+		cfg, err := readConfig("test.yaml", strings.NewReader(yaml))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.applyFlags()
+		return cfg
+	}
+	running := read("exporter:\n  timeout: 5s\n  max-concurrency: 2\n")
+
+	// Options and the timeout can be changed without a restart.
+	if keys := read("exporter:\n  timeout: 10s\n  max-concurrency: 4\n").restartRequired(running); len(keys) != 0 {
+		t.Errorf("Expected no restart to be required, got %v", keys)
+	}
+	got := read(`
+exporter:
+  timeout: 10s
+  stream: false
+  sinks:
+  - textfile: /tmp/sense.prom
+`).restartRequired(running)
+	if want := []string{"stream", "sinks"}; !slices.Equal(got, want) {
+		t.Errorf("Expected %v to require a restart, got %v", want, got)
+	}
+}
@@ -7,11 +7,15 @@ import (
 	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/dnesting/sense"
 	exporter "github.com/dnesting/sense-exporter"
 	"github.com/dnesting/sense/sensecli"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
 )
@@ -27,10 +31,16 @@ var (
 	*/
 
 	// config
+	flagConfig  = flag.String("config", "", "read exporter settings from the \"exporter\" section of this YAML file")
 	flagAddr    = flag.String("listen", ":9553", "listen address for HTTP server")
 	flagDebug   = flag.Bool("debug", false, "enable debugging")
 	flagTimeout = flag.Duration("timeout", 10*time.Second, "timeout for a collection")
 	flagJaeger  = flag.String("jaeger", "", "jaeger endpoint (e.g. http://localhost:14268/api/traces)")
+	flagStream  = flag.Bool("stream", true, "keep a persistent stream open to each monitor instead of connecting on each scrape")
+	flagState   = flag.String("state-file", "", "file in which to persist energy counters across restarts")
+	flagSlim    = flag.Bool("device-id-labels-only", false, "label per-device metrics with only device_id (see sense_device_info)")
+	flagTokens  = flag.String("token-cache", "", "file in which to cache Sense auth tokens across restarts")
+	flagRefresh = flag.Duration("monitor-refresh", 0, "how often to log in again to look for added or removed monitors (0 to disable)")
 )
 
 var (
@@ -42,6 +52,12 @@ var indexContent []byte
 
 const traceName = "github.com/dnesting/sense-exporter"
 
+// stateInterval is how often we save energy counters to -state-file.  If we
+// exit without saving them, they go back to what they were when we last did,
+// which looks like a counter reset, so this should be well under any scrape
+// interval.
+const stateInterval = 5 * time.Second
+
 func main() {
 	configFile, creds := sensecli.SetupStandardFlags()
 	flag.Parse()
@@ -50,6 +66,15 @@ func main() {
 		return
 	}
 
+	cfg := &config{}
+	if *flagConfig != "" {
+		var err error
+		if cfg, err = loadConfig(*flagConfig); err != nil {
+			log.Fatal(err)
+		}
+	}
+	cfg.applyFlags()
+
 	httpClient := http.DefaultClient
 	ctx := context.Background()
 	if *flagJaeger != "" {
@@ -72,32 +97,146 @@ func main() {
 		httpClient = sense.SetDebug(log.Default(), httpClient)
 	}
 
+	var tokens *tokenCache
+	if cfg.TokenCache != "" {
+		var err error
+		if tokens, err = newTokenCache(cfg.TokenCache, httpClient.Transport); err != nil {
+			log.Fatal(err)
+		}
+		httpClient = &http.Client{Transport: tokens}
+	}
+
+	// So that errors can be classified by their HTTP status.
+	httpClient = &http.Client{Transport: statusTransport{httpClient.Transport}}
+
 	ctx, span := otel.Tracer(traceName).Start(ctx, "Setup")
-	cls, err := sensecli.CreateClients(ctx, configFile, creds, sense.WithHttpClient(httpClient))
+	cs := newClientSet(*configFile, func(ctx context.Context, configFile *string) ([]*sense.Client, error) {
+		return sensecli.CreateClients(ctx, configFile, creds, sense.WithHttpClient(httpClient))
+	})
+	rl := &reloader{cs: cs}
+	cls, err := cs.load(ctx)
+	if err != nil && tokens != nil {
+		// Perhaps a cached token was no good.
+		log.Println(err)
+		log.Println("retrying without cached tokens")
+		tokens.clear()
+		cls, err = cs.load(ctx)
+	}
 	if err != nil {
 		span.RecordError(err)
 		log.Fatal(err)
 	}
-	for _, cl := range cls {
-		if cl.GetAccountID() > 0 {
-			log.Printf("successfully authenticated account %d (monitors %v)", cl.GetAccountID(), cl.GetMonitors())
+
+	runCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	exp := exporter.NewExporter(exporterClients(cls), cfg.Timeout)
+	exp.SetOptions(cfg.Options)
+	exp.SetReauthenticator(cs.reauth)
+	if cfg.StateFile != "" {
+		if err := exp.LoadEnergy(cfg.StateFile); err != nil {
+			span.RecordError(err)
+			log.Fatal(err)
 		}
 	}
-
-	// Convert sense.Client to exporter.Client interface
-	clients := make([]exporter.Client, len(cls))
-	for i, cl := range cls {
-		clients[i] = cl
+	if *cfg.Stream {
+		exp.Start(runCtx)
+	}
+	if cfg.StateFile != "" {
+		go saveState(runCtx, exp, cfg.StateFile)
+	}
+	for _, s := range cfg.Sinks {
+		go writeTextfile(runCtx, exp, s.Textfile, s.Interval)
+	}
+	if cfg.MonitorRefresh > 0 {
+		go refreshMonitors(runCtx, exp, cs, cfg.MonitorRefresh)
 	}
 
-	exp := exporter.NewExporter(clients, *flagTimeout)
+	rl.setExporter(exp, cfg)
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			log.Println("received SIGHUP, reloading")
+			if err := rl.reload(context.Background()); err != nil {
+				log.Println("reload failed:", err)
+			}
+		}
+	}()
 
 	http.Handle("/metrics", otelhttp.NewHandler(exp, "/metrics"))
+	http.Handle("/probe", otelhttp.NewHandler(http.HandlerFunc(exp.ServeProbe), "/probe"))
+	http.HandleFunc("/targets", exp.ServeTargets)
+	http.Handle("/-/reload", rl)
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html")
 		w.Write(indexContent)
 	})
+	srv := &http.Server{Addr: *flagAddr}
+	go func() {
+		<-runCtx.Done()
+		srv.Shutdown(context.Background())
+	}()
 	log.Println("listening on", *flagAddr)
 	span.End()
-	log.Fatal(http.ListenAndServe(*flagAddr, nil))
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	log.Println("shutting down")
+	if cfg.StateFile != "" {
+		if err := exp.SaveEnergy(cfg.StateFile); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// saveState periodically saves the exporter's energy counters to path until
+// ctx is canceled.
+func saveState(ctx context.Context, exp *exporter.Exporter, path string) {
+	t := time.NewTicker(stateInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := exp.SaveEnergy(path); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// refreshMonitors periodically looks for monitors added to or removed from
+// each account until ctx is canceled.
+func refreshMonitors(ctx context.Context, exp *exporter.Exporter, cs *clientSet, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := exp.RefreshMonitors(ctx, cs.refresh); err != nil {
+				log.Println("refreshing monitors:", err)
+			}
+		}
+	}
+}
+
+// writeTextfile periodically writes the exporter's metrics to path in the
+// Prometheus text format until ctx is canceled.
+func writeTextfile(ctx context.Context, exp *exporter.Exporter, path string, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := prometheus.WriteToTextfile(path, exp); err != nil {
+				log.Println(err)
+			}
+		}
+	}
 }
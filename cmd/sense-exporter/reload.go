@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/dnesting/sense"
+	exporter "github.com/dnesting/sense-exporter"
+	"gopkg.in/yaml.v3"
+)
+
+// createFunc creates clients for the accounts in the given sensecli config
+// file, or from flags if it's empty.
+type createFunc func(ctx context.Context, configFile *string) ([]*sense.Client, error)
+
+// clientSet tracks the clients created for each account in the sensecli
+// config file, so that on reload we only log in again (and possibly prompt
+// for MFA) for accounts whose configuration changed.
+type clientSet struct {
+	configFile string
+	create     createFunc
+
+	mu        sync.Mutex
+	byAccount map[string]*sense.Client // by account.key
+	accounts  []account                // as of the last load
+	clients   []*sense.Client
+}
+
+func newClientSet(configFile string, create createFunc) *clientSet {
+	return &clientSet{
+		configFile: configFile,
+		create:     create,
+		byAccount:  make(map[string]*sense.Client),
+	}
+}
+
+// account is an entry in the accounts section of the sensecli config file.
+type account struct {
+	key  string // canonical form of the account's configuration
+	node *yaml.Node
+}
+
+// readAccounts returns the accounts in the config file.  Accounts with the
+// same key are configured identically.
+func readAccounts(configFile string) ([]account, error) {
+	b, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	var f struct {
+		Accounts []*yaml.Node `yaml:"accounts"`
+	}
+	if err := yaml.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", configFile, err)
+	}
+	var accts []account
+	for _, n := range f.Accounts {
+		// Re-encoding gives us a canonical form that ignores formatting.
+		k, err := yaml.Marshal(n)
+		if err != nil {
+			return nil, err
+		}
+		accts = append(accts, account{string(k), n})
+	}
+	return accts, nil
+}
+
+// load creates clients for any accounts that are new or changed since the
+// last load, and returns the full set of clients.  If anything fails, the
+// previous clients remain in effect.
+func (cs *clientSet) load(ctx context.Context) ([]*sense.Client, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.configFile == "" {
+		// Credentials come from flags or the environment, which can't
+		// change, so we only need to do this once.
+		if cs.clients == nil {
+			cls, err := cs.create(ctx, &cs.configFile)
+			if err != nil {
+				return nil, err
+			}
+			logClients(cls)
+			cs.clients = cls
+		}
+		return cs.clients, nil
+	}
+
+	accts, err := readAccounts(cs.configFile)
+	if err != nil {
+		return nil, err
+	}
+	var changed []account
+	for _, a := range accts {
+		if _, ok := cs.byAccount[a.key]; !ok {
+			changed = append(changed, a)
+		}
+	}
+
+	byAccount := make(map[string]*sense.Client)
+	if len(changed) > 0 {
+		var cls []*sense.Client
+		if len(changed) == len(accts) {
+			cls, err = cs.create(ctx, &cs.configFile)
+		} else {
+			cls, err = cs.createAccounts(ctx, changed)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(cls) != len(changed) {
+			return nil, fmt.Errorf("expected %d clients, got %d", len(changed), len(cls))
+		}
+		logClients(cls)
+		for i, a := range changed {
+			byAccount[a.key] = cls[i]
+		}
+	}
+
+	var clients []*sense.Client
+	for _, a := range accts {
+		cl, ok := byAccount[a.key]
+		if !ok {
+			cl = cs.byAccount[a.key]
+			byAccount[a.key] = cl
+		}
+		clients = append(clients, cl)
+	}
+	cs.byAccount = byAccount
+	cs.accounts = accts
+	cs.clients = clients
+	return clients, nil
+}
+
+// createAccounts creates clients for just the given accounts, by writing them
+// to a temporary config file.  We try to put this alongside the real one, in
+// case sensecli resolves relative paths against it.
+func (cs *clientSet) createAccounts(ctx context.Context, accts []account) ([]*sense.Client, error) {
+	var f struct {
+		Accounts []*yaml.Node `yaml:"accounts"`
+	}
+	for _, a := range accts {
+		f.Accounts = append(f.Accounts, a.node)
+	}
+	b, err := yaml.Marshal(&f)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(cs.configFile), ".sense-accounts-*.yaml")
+	if err != nil {
+		tmp, err = os.CreateTemp("", "sense-accounts-*.yaml")
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	name := tmp.Name()
+	return cs.create(ctx, &name)
+}
+
+// invalidate forgets the clients for the given account, so that the next load
+// logs in again.
+func (cs *clientSet) invalidate(accountID int) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for k, cl := range cs.byAccount {
+		if cl.GetAccountID() == accountID {
+			delete(cs.byAccount, k)
+		}
+	}
+	if cs.configFile == "" {
+		cs.clients = nil
+	}
+}
+
+// reauth logs in again to the account used by cl, after Sense rejected its
+// credentials.
+func (cs *clientSet) reauth(ctx context.Context, cl exporter.Client) (exporter.Client, error) {
+	cs.invalidate(cl.GetAccountID())
+	cls, err := cs.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, newCl := range cls {
+		if newCl.GetAccountID() == cl.GetAccountID() {
+			return exporterClient(newCl), nil
+		}
+	}
+	return nil, fmt.Errorf("account %d is no longer configured", cl.GetAccountID())
+}
+
+// refresh logs in again to the account used by cl, so that we learn about
+// any changes to its monitors.  If possible, this bypasses the token cache.
+// Unlike reauth, this uses the account's configuration from the last load
+// rather than reading the config file again.  If the account's monitors are
+// unchanged, refresh returns cl, so that the exporter can keep using it.
+func (cs *clientSet) refresh(ctx context.Context, cl exporter.Client) (exporter.Client, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	ctx = withFreshLogin(ctx)
+
+	var (
+		cls []*sense.Client
+		key string
+		err error
+	)
+	if cs.configFile == "" {
+		cls, err = cs.create(ctx, &cs.configFile)
+	} else {
+		i := slices.IndexFunc(cs.accounts, func(a account) bool {
+			return exporterClient(cs.byAccount[a.key]) == cl
+		})
+		if i < 0 {
+			return nil, fmt.Errorf("account %d is no longer configured", cl.GetAccountID())
+		}
+		key = cs.accounts[i].key
+		cls, err = cs.createAccounts(ctx, cs.accounts[i:i+1])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, newCl := range cls {
+		if newCl.GetAccountID() != cl.GetAccountID() {
+			continue
+		}
+		if sameMonitors(newCl.GetMonitors(), cl.GetMonitors()) {
+			return cl, nil
+		}
+		for i, old := range cs.clients {
+			if exporterClient(old) == cl {
+				cs.clients[i] = newCl
+			}
+		}
+		if key != "" {
+			cs.byAccount[key] = newCl
+		}
+		return exporterClient(newCl), nil
+	}
+	return nil, fmt.Errorf("account %d is no longer configured", cl.GetAccountID())
+}
+
+// sameMonitors reports whether a and b list the same monitors.
+func sameMonitors(a, b []sense.Monitor) bool {
+	ids := func(ms []sense.Monitor) []int {
+		var ids []int
+		for _, m := range ms {
+			ids = append(ids, m.ID)
+		}
+		slices.Sort(ids)
+		return ids
+	}
+	return slices.Equal(ids(a), ids(b))
+}
+
+func logClients(cls []*sense.Client) {
+	for _, cl := range cls {
+		if cl.GetAccountID() > 0 {
+			log.Printf("successfully authenticated account %d (monitors %v)", cl.GetAccountID(), cl.GetMonitors())
+		}
+	}
+}
+
+// exporterClient converts sense.Client to the exporter.Client interface.
+// Every call returns an equal value for the same cl.
+func exporterClient(cl *sense.Client) exporter.Client {
+	return statusClient{cl}
+}
+
+// exporterClients converts each of cls with exporterClient.
+func exporterClients(cls []*sense.Client) []exporter.Client {
+	clients := make([]exporter.Client, len(cls))
+	for i, cl := range cls {
+		clients[i] = exporterClient(cl)
+	}
+	return clients
+}
+
+// reloader re-reads the config files and applies any changes to the exporter.
+type reloader struct {
+	cs *clientSet
+
+	mu      sync.Mutex
+	exp     *exporter.Exporter // nil until setExporter
+	running *config            // the config exp was started with
+}
+
+func (r *reloader) setExporter(exp *exporter.Exporter, cfg *config) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.exp = exp
+	r.running = cfg
+}
+
+func (r *reloader) reload(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cfg := &config{}
+	if *flagConfig != "" {
+		var err error
+		if cfg, err = loadConfig(*flagConfig); err != nil {
+			return err
+		}
+	}
+	cfg.applyFlags()
+
+	cls, err := r.cs.load(ctx)
+	if err != nil {
+		return err
+	}
+	for _, key := range cfg.restartRequired(r.running) {
+		log.Printf("warning: exporter.%s changed, but this requires a restart", key)
+	}
+	r.exp.Reconfigure(cfg.Options, exporterClients(cls), cfg.Timeout)
+	log.Println("configuration reloaded")
+	return nil
+}
+
+// ServeHTTP implements the /-/reload endpoint.
+func (r *reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "reload requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	// Clients may hold on to the context, so it must outlive the request.
+	if err := r.reload(context.WithoutCancel(req.Context())); err != nil {
+		log.Println("reload failed:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
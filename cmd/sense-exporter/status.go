@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/dnesting/sense"
+	exporter "github.com/dnesting/sense-exporter"
+	"github.com/dnesting/sense/realtime"
+)
+
+// The exporter needs the HTTP status of a failed call to tell whether Sense
+// rejected our credentials or wants us to slow down, but the errors returned
+// by sense.Client don't say.  So statusTransport notes the status of each
+// response on behalf of the call that made the request, and statusClient
+// attaches it to the call's error.
+
+// statusKey is the context key for the *atomic.Int32 in which
+// statusTransport records the status of the last response.
+type statusKey struct{}
+
+// statusTransport records the status of responses to requests made on
+// behalf of a statusClient.
+type statusTransport struct {
+	base http.RoundTripper
+}
+
+func (t statusTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	if status, ok := req.Context().Value(statusKey{}).(*atomic.Int32); ok && err == nil {
+		status.Store(int32(resp.StatusCode))
+	}
+	return resp, err
+}
+
+// statusError is an error from Sense along with the HTTP status of the
+// response that caused it.
+type statusError struct {
+	status int
+	err    error
+}
+
+func (e *statusError) Error() string   { return e.err.Error() + " (HTTP " + strconv.Itoa(e.status) + ")" }
+func (e *statusError) Unwrap() error   { return e.err }
+func (e *statusError) StatusCode() int { return e.status }
+
+// withStatus returns a context under which statusTransport records response
+// statuses, and a function that attaches the last one to an error, if it was
+// a failure.
+func withStatus(ctx context.Context) (context.Context, func(error) error) {
+	status := new(atomic.Int32)
+	ctx = context.WithValue(ctx, statusKey{}, status)
+	return ctx, func(err error) error {
+		if s := int(status.Load()); err != nil && s >= http.StatusBadRequest {
+			return &statusError{s, err}
+		}
+		return err
+	}
+}
+
+// statusClient wraps a client so that its errors carry the HTTP status of
+// the failed request.  Its requests must go through a statusTransport.
+type statusClient struct {
+	exporter.Client
+}
+
+func (c statusClient) GetDevices(ctx context.Context, monitor int, includeMerged bool) ([]sense.Device, error) {
+	ctx, withErr := withStatus(ctx)
+	devices, err := c.Client.GetDevices(ctx, monitor, includeMerged)
+	return devices, withErr(err)
+}
+
+func (c statusClient) Stream(ctx context.Context, monitor int, callback realtime.Callback) error {
+	ctx, withErr := withStatus(ctx)
+	return withErr(c.Client.Stream(ctx, monitor, callback))
+}
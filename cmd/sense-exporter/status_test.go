@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dnesting/sense"
+	exporter "github.com/dnesting/sense-exporter"
+	"github.com/dnesting/sense/realtime"
+)
+
+// httpClient is an exporter.Client that, like sense.Client, makes a request
+// to Sense for each call and reports any failure without its status.
+type httpClient struct {
+	hc *http.Client
+}
+
+func (c httpClient) GetUserID() int               { return 2 }
+func (c httpClient) GetAccountID() int            { return 1 }
+func (c httpClient) GetMonitors() []sense.Monitor { return []sense.Monitor{{ID: 100}} }
+
+func (c httpClient) get(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.sense.com/apiservice/api/v1/app/monitors/100/devices", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("unexpected response")
+	}
+	return nil
+}
+
+func (c httpClient) GetDevices(ctx context.Context, monitor int, includeMerged bool) ([]sense.Device, error) {
+	return nil, c.get(ctx)
+}
+
+func (c httpClient) Stream(ctx context.Context, monitor int, callback realtime.Callback) error {
+	return c.get(ctx)
+}
+
+func TestStatusClient(t *testing.T) {
+	fake := &fakeSense{reject: true}
+	cl := statusClient{httpClient{&http.Client{Transport: statusTransport{fake}}}}
+
+	_, err := cl.GetDevices(context.Background(), 100, false)
+	var sc interface{ StatusCode() int }
+	if !errors.As(err, &sc) || sc.StatusCode() != http.StatusUnauthorized {
+		t.Fatalf("Expected an error with status 401, got %v", err)
+	}
+
+	// The exporter sees that Sense rejected our credentials.
+	exp := exporter.NewExporter([]exporter.Client{cl}, time.Second)
+	rec := httptest.NewRecorder()
+	exp.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	if want := `sense_scrape_errors_total{monitor="100",reason="auth",stage="devices"} 1`; !strings.Contains(body, want) {
+		t.Errorf("Expected %s:\n%s", want, body)
+	}
+
+	// As does being asked to slow down.
+	fake.reject = false
+	fake.limit = true
+	rec = httptest.NewRecorder()
+	exp.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body = rec.Body.String()
+	for _, want := range []string{
+		`sense_scrape_errors_total{monitor="100",reason="rate_limited",stage="devices"} 1`,
+		// From the first scrape, which may not have been reported in time for it.
+		`sense_account_authenticated{account="1"} 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %s:\n%s", want, body)
+		}
+	}
+
+	// Successful calls are left alone.
+	fake.limit = false
+	if _, err := cl.GetDevices(context.Background(), 100, false); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
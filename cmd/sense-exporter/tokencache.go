@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// tokenCache is an http.RoundTripper that remembers the responses to Sense's
+// authentication requests, by e-mail address, and persists them to a file.
+// When the sense client logs in again later (typically after a restart), we
+// answer from the cache instead of contacting Sense, which avoids having to
+// prompt for an MFA code.
+//
+// If Sense later rejects a cached access token, we forget it so that the next
+// login goes to Sense, but keep the rest of the entry so that if the client
+// renews its tokens instead, we can cache the new ones.  Logins made with a
+// context from withFreshLogin also go to Sense, unless it wants an MFA code.
+type tokenCache struct {
+	path string
+	next http.RoundTripper
+
+	mu       sync.Mutex
+	entries  map[string]*tokenEntry // by e-mail address
+	mfaEmail map[string]string      // e-mail address by MFA token
+}
+
+// tokenEntry holds a successful authentication response.
+type tokenEntry struct {
+	Response json.RawMessage `json:"response"`
+}
+
+// authResponse holds the fields we care about from an authentication response.
+type authResponse struct {
+	AccountID    int    `json:"account_id"`
+	UserID       int    `json:"user_id"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	MfaToken     string `json:"mfa_token"`
+}
+
+func (e *tokenEntry) parse() authResponse {
+	var a authResponse
+	json.Unmarshal(e.Response, &a)
+	return a
+}
+
+// usable reports whether the entry still has an access token we can hand out.
+func (e *tokenEntry) usable() bool {
+	return e.parse().AccessToken != ""
+}
+
+// setTokens replaces the tokens in the cached response.  An empty refresh
+// token leaves the existing one in place.
+func (e *tokenEntry) setTokens(access, refresh string) {
+	var m map[string]any
+	if err := json.Unmarshal(e.Response, &m); err != nil {
+		return
+	}
+	m["access_token"] = access
+	if refresh != "" {
+		m["refresh_token"] = refresh
+	}
+	if b, err := json.Marshal(m); err == nil {
+		e.Response = b
+	}
+}
+
+// newTokenCache creates a tokenCache backed by the file at path, loading any
+// tokens previously saved there.
+func newTokenCache(path string, next http.RoundTripper) (*tokenCache, error) {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	tc := &tokenCache{
+		path:     path,
+		next:     next,
+		entries:  make(map[string]*tokenEntry),
+		mfaEmail: make(map[string]string),
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return tc, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &tc.entries); err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
+
+// clear discards all cached tokens.
+func (tc *tokenCache) clear() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	clear(tc.entries)
+	tc.save()
+}
+
+// save writes the cache to disk.  tc.mu must be held.
+func (tc *tokenCache) save() {
+	if err := tc.write(); err != nil {
+		log.Println("saving token cache:", err)
+	}
+}
+
+func (tc *tokenCache) write() error {
+	b, err := json.Marshal(tc.entries)
+	if err != nil {
+		return err
+	}
+	// CreateTemp creates the file readable only by us, which is what we
+	// want for tokens.
+	tmp, err := os.CreateTemp(filepath.Dir(tc.path), filepath.Base(tc.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), tc.path)
+}
+
+func (tc *tokenCache) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch {
+	case req.Method == http.MethodPost && strings.HasSuffix(req.URL.Path, "/authenticate"):
+		return tc.authenticate(req)
+	case req.Method == http.MethodPost && strings.HasSuffix(req.URL.Path, "/authenticate/mfa"):
+		return tc.authenticateMFA(req)
+	case req.Method == http.MethodPost && strings.HasSuffix(req.URL.Path, "/renew"):
+		return tc.renew(req)
+	}
+
+	resp, err := tc.next.RoundTrip(req)
+	if err == nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+		tc.reject(requestToken(req))
+	}
+	return resp, err
+}
+
+// authenticate answers a login request from the cache if we can, otherwise
+// passes it on to Sense and caches a successful response.
+func (tc *tokenCache) authenticate(req *http.Request) (*http.Response, error) {
+	form, req, err := readForm(req)
+	if err != nil {
+		return nil, err
+	}
+	email := form.Get("email")
+
+	tc.mu.Lock()
+	entry, ok := tc.entries[email]
+	tc.mu.Unlock()
+	fresh := req.Context().Value(freshLoginKey{}) != nil
+	if ok && entry.usable() && !fresh {
+		log.Printf("using cached token for %s", email)
+		return entry.response(req), nil
+	}
+
+	resp, body, err := tc.forward(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		tc.store(email, body)
+	case http.StatusUnauthorized:
+		// Sense wants an MFA code.
+		var a authResponse
+		if json.Unmarshal(body, &a) != nil || a.MfaToken == "" {
+			break
+		}
+		if ok && entry.usable() {
+			// There's probably nobody around to provide one, so
+			// settle for what we have.
+			log.Printf("using cached token for %s", email)
+			return entry.response(req), nil
+		}
+		// Remember who this was for.
+		tc.mu.Lock()
+		tc.mfaEmail[a.MfaToken] = email
+		tc.mu.Unlock()
+	}
+	return resp, nil
+}
+
+// response creates a response to req from the cache entry.
+func (e *tokenEntry) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(e.Response)),
+		ContentLength: int64(len(e.Response)),
+		Request:       req,
+	}
+}
+
+// freshLoginKey is the context key used by withFreshLogin.
+type freshLoginKey struct{}
+
+// withFreshLogin returns a context that makes logins bypass the token cache,
+// so that we get up-to-date information from Sense.
+func withFreshLogin(ctx context.Context) context.Context {
+	return context.WithValue(ctx, freshLoginKey{}, true)
+}
+
+// authenticateMFA caches the response to a successful MFA login.
+func (tc *tokenCache) authenticateMFA(req *http.Request) (*http.Response, error) {
+	form, req, err := readForm(req)
+	if err != nil {
+		return nil, err
+	}
+	tc.mu.Lock()
+	email, ok := tc.mfaEmail[form.Get("mfa_token")]
+	delete(tc.mfaEmail, form.Get("mfa_token"))
+	tc.mu.Unlock()
+
+	resp, body, err := tc.forward(req)
+	if err != nil {
+		return nil, err
+	}
+	if ok && resp.StatusCode == http.StatusOK {
+		tc.store(email, body)
+	}
+	return resp, nil
+}
+
+// renew updates the cached tokens when the client refreshes them.
+func (tc *tokenCache) renew(req *http.Request) (*http.Response, error) {
+	resp, body, err := tc.forward(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	var renewed authResponse
+	if err := json.Unmarshal(body, &renewed); err != nil {
+		return resp, nil
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	for _, entry := range tc.entries {
+		if entry.parse().UserID == renewed.UserID {
+			entry.setTokens(renewed.AccessToken, renewed.RefreshToken)
+		}
+	}
+	tc.save()
+	return resp, nil
+}
+
+func (tc *tokenCache) store(email string, body []byte) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.entries[email] = &tokenEntry{Response: body}
+	tc.save()
+}
+
+// reject forgets token, if it's cached.
+func (tc *tokenCache) reject(token string) {
+	if token == "" {
+		return
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	for email, entry := range tc.entries {
+		if entry.parse().AccessToken == token {
+			log.Printf("cached token for %s was rejected", email)
+			entry.setTokens("", "")
+			tc.save()
+		}
+	}
+}
+
+// forward passes req on to Sense and reads the response body, leaving a copy
+// in resp.Body for the caller.
+func (tc *tokenCache) forward(req *http.Request) (*http.Response, []byte, error) {
+	resp, err := tc.next.RoundTrip(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, body, nil
+}
+
+// readForm parses the form in the body of req, returning a copy of req with
+// the body intact.
+func readForm(req *http.Request) (url.Values, *http.Request, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	req = req.Clone(req.Context())
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	form, err := url.ParseQuery(string(body))
+	return form, req, err
+}
+
+// requestToken returns the access token used to authorize req.
+func requestToken(req *http.Request) string {
+	if h := req.Header.Get("Authorization"); h != "" {
+		if _, token, ok := strings.Cut(h, " "); ok {
+			return token
+		}
+		return h
+	}
+	return req.URL.Query().Get("access_token")
+}
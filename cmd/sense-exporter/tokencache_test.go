@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSense answers authentication requests the way Sense does, counting
+// the requests that reach it.
+type fakeSense struct {
+	mu       sync.Mutex
+	requests map[string]int // by path
+	mfa      bool           // require an MFA code to log in
+	token    string         // access token to issue
+	reject   bool           // reject all other requests with 401
+	limit    bool           // reject all other requests with 429
+}
+
+func (f *fakeSense) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.requests == nil {
+		f.requests = make(map[string]int)
+	}
+	f.requests[req.URL.Path]++
+
+	status := http.StatusOK
+	var body any
+	switch req.URL.Path {
+	case "/apiservice/api/v1/authenticate":
+		if f.mfa {
+			status = http.StatusUnauthorized
+			body = map[string]any{"mfa_token": "mfa123"}
+		} else {
+			body = map[string]any{"account_id": 1, "user_id": 2, "access_token": f.token}
+		}
+	case "/apiservice/api/v1/authenticate/mfa":
+		body = map[string]any{"account_id": 1, "user_id": 2, "access_token": f.token}
+	case "/apiservice/api/v1/renew":
+		body = map[string]any{"user_id": 2, "access_token": f.token, "refresh_token": "refresh-" + f.token}
+	default:
+		if f.reject {
+			status = http.StatusUnauthorized
+		} else if f.limit {
+			status = http.StatusTooManyRequests
+		}
+		body = map[string]any{}
+	}
+	b, _ := json.Marshal(body)
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(string(b))),
+		Request:    req,
+	}, nil
+}
+
+func (f *fakeSense) count(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests["/apiservice/api/v1/"+path]
+}
+
+// login sends an authentication request through tc and returns the status
+// and access token in the response.
+func login(t *testing.T, ctx context.Context, tc *tokenCache, email string) (int, string) {
+	t.Helper()
+	form := url.Values{"email": {email}, "password": {"secret"}}
+	return post(t, ctx, tc, "authenticate", form)
+}
+
+// post sends form to the given Sense API path through tc.
+func post(t *testing.T, ctx context.Context, tc *tokenCache, path string, form url.Values) (int, string) {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		"https://api.sense.com/apiservice/api/v1/"+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := tc.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var a authResponse
+	json.NewDecoder(resp.Body).Decode(&a)
+	return resp.StatusCode, a.AccessToken
+}
+
+func TestTokenCache(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	sense := &fakeSense{token: "token1"}
+	tc, err := newTokenCache(path, sense)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A miss goes to Sense, and the response is saved, readable only by us.
+	if status, token := login(t, ctx, tc, "a@example.com"); status != http.StatusOK || token != "token1" {
+		t.Fatalf("Expected token1, got %d %q", status, token)
+	}
+	if n := sense.count("authenticate"); n != 1 {
+		t.Errorf("Expected 1 login to reach Sense, got %d", n)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0o600 {
+		t.Errorf("Expected token cache to have mode 0600, got %o", mode)
+	}
+
+	// A hit, even after a restart, is answered from the cache.
+	sense.token = "token2"
+	if tc, err = newTokenCache(path, sense); err != nil {
+		t.Fatal(err)
+	}
+	if _, token := login(t, ctx, tc, "a@example.com"); token != "token1" {
+		t.Errorf("Expected cached token1, got %q", token)
+	}
+	if n := sense.count("authenticate"); n != 1 {
+		t.Errorf("Expected the cache to answer, but %d logins reached Sense", n)
+	}
+
+	// Fresh logins go to Sense.
+	if _, token := login(t, withFreshLogin(ctx), tc, "a@example.com"); token != "token2" {
+		t.Errorf("Expected fresh token2, got %q", token)
+	}
+
+	// Unless Sense wants an MFA code, in which case we settle for the
+	// cached token.
+	sense.mfa = true
+	sense.token = "token3"
+	if status, token := login(t, withFreshLogin(ctx), tc, "a@example.com"); status != http.StatusOK || token != "token2" {
+		t.Errorf("Expected to fall back to cached token2, got %d %q", status, token)
+	}
+
+	// Without a cached token, the MFA response is passed along, and the
+	// result of the MFA login is cached.
+	if status, _ := login(t, ctx, tc, "b@example.com"); status != http.StatusUnauthorized {
+		t.Errorf("Expected MFA challenge for uncached account, got %d", status)
+	}
+	post(t, ctx, tc, "authenticate/mfa", url.Values{"mfa_token": {"mfa123"}, "totp": {"123456"}})
+	if _, token := login(t, ctx, tc, "b@example.com"); token != "token3" {
+		t.Errorf("Expected cached token3 after MFA, got %q", token)
+	}
+
+	// A rejected token is discarded, so the next login goes to Sense.
+	sense.reject = true
+	req, _ := http.NewRequest(http.MethodGet, "https://api.sense.com/apiservice/api/v1/app/monitors/1/devices", nil)
+	req.Header.Set("Authorization", "bearer token2")
+	resp, err := tc.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	sense.mfa = false
+	sense.token = "token4"
+	before := sense.count("authenticate")
+	if _, token := login(t, ctx, tc, "a@example.com"); token != "token4" {
+		t.Errorf("Expected new token4 after rejection, got %q", token)
+	}
+	if n := sense.count("authenticate"); n != before+1 {
+		t.Errorf("Expected login after rejection to reach Sense")
+	}
+	// Other accounts are unaffected.
+	if _, token := login(t, ctx, tc, "b@example.com"); token != "token3" {
+		t.Errorf("Expected cached token3 for other account, got %q", token)
+	}
+
+	// If the client renews a rejected token instead, the renewed token is
+	// cached and used after a restart.
+	req.Header.Set("Authorization", "bearer token4")
+	resp, err = tc.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	sense.reject = false
+	sense.token = "token5"
+	post(t, ctx, tc, "renew", url.Values{"user_id": {"2"}, "refresh_token": {"refresh"}})
+	if tc, err = newTokenCache(path, sense); err != nil {
+		t.Fatal(err)
+	}
+	before = sense.count("authenticate")
+	if _, token := login(t, ctx, tc, "a@example.com"); token != "token5" {
+		t.Errorf("Expected renewed token5 after restart, got %q", token)
+	}
+	if n := sense.count("authenticate"); n != before {
+		t.Errorf("Expected the cache to answer after renewal, but %d logins reached Sense", n-before)
+	}
+}
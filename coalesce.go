@@ -0,0 +1,70 @@
+package exporter
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sharedCollection lets concurrent requests for the same monitor share a
+// single collection from Sense, and optionally reuse its result for a while
+// afterward.
+type sharedCollection struct {
+	mu       sync.Mutex
+	inflight *collection
+	last     *collection
+}
+
+// collection is the result of collecting from a monitor.
+type collection struct {
+	done    chan struct{} // closed once metrics is set
+	metrics []prometheus.Metric
+	at      time.Time
+}
+
+// do returns the metrics from a collection in progress, or from one that
+// finished less than minInterval ago, or else calls fn to collect them.
+// If ctx is done before the metrics are available, do returns nil.  fn must
+// not panic; see gather.
+func (s *sharedCollection) do(ctx context.Context, minInterval time.Duration, fn func() []prometheus.Metric) []prometheus.Metric {
+	s.mu.Lock()
+	if f := s.inflight; f != nil {
+		s.mu.Unlock()
+		select {
+		case <-f.done:
+			return f.metrics
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	if f := s.last; f != nil && minInterval > 0 && time.Since(f.at) < minInterval {
+		s.mu.Unlock()
+		return f.metrics
+	}
+	f := &collection{done: make(chan struct{})}
+	s.inflight = f
+	s.mu.Unlock()
+
+	f.metrics = fn()
+	f.at = time.Now()
+	s.mu.Lock()
+	s.inflight = nil
+	s.last = f
+	s.mu.Unlock()
+	close(f.done)
+	return f.metrics
+}
+
+// sharedCollection returns the sharedCollection for the given monitor, when
+// collected using cl.  e.mu must be held.
+func (e *Exporter) sharedCollection(cl Client, monitor int) *sharedCollection {
+	k := monitorClient{cl, monitor}
+	s, ok := e.shared[k]
+	if !ok {
+		s = &sharedCollection{}
+		e.shared[k] = s
+	}
+	return s
+}
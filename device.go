@@ -0,0 +1,114 @@
+package exporter
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/dnesting/sense"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// deviceLabels are the descriptive labels normally attached to per-device
+// metrics.
+var deviceLabels = []string{"device_id", "name", "type", "make", "model"}
+
+// deviceInfoLabels are the labels attached to sense_device_info.
+var deviceInfoLabels = append(slices.Clip(deviceLabels), "icon", "tags", "source")
+
+// deviceDesc describes a per-device metric.  These normally carry all of the
+// device's descriptive labels, but with Options.DeviceIDLabelsOnly they carry
+// only device_id, and the rest can be found by joining with sense_device_info.
+// Either way, they're followed by any labels configured with
+// DeviceOverride.Labels.
+type deviceDesc struct {
+	name, help string
+	info       bool // carries deviceInfoLabels regardless of options
+
+	descs sync.Map // *prometheus.Desc by comma-separated label names
+}
+
+func newDeviceDesc(name, help string) *deviceDesc {
+	return &deviceDesc{name: name, help: help}
+}
+
+// desc returns the prometheus.Desc to use with opts.
+func (d *deviceDesc) desc(opts *Options) *prometheus.Desc {
+	labels := deviceLabels
+	if d.info {
+		labels = deviceInfoLabels
+	} else if opts.DeviceIDLabelsOnly {
+		labels = deviceLabels[:1]
+	}
+	labels = append(slices.Clip(labels), opts.deviceLabelNames()...)
+	key := strings.Join(labels, ",")
+	if desc, ok := d.descs.Load(key); ok {
+		return desc.(*prometheus.Desc)
+	}
+	desc, _ := d.descs.LoadOrStore(key, prometheus.NewDesc(d.name, d.help, labels, nil))
+	return desc.(*prometheus.Desc)
+}
+
+func (d *deviceDesc) describe(ch chan<- *prometheus.Desc, opts *Options) {
+	ch <- d.desc(opts)
+}
+
+// metric creates a metric for dev.  For sense_device_info, extra holds the
+// values of the labels following the device's descriptive labels.
+func (d *deviceDesc) metric(opts *Options, dev sense.Device, valueType prometheus.ValueType, value float64, extra ...string) prometheus.Metric {
+	values := []string{dev.ID}
+	if d.info || !opts.DeviceIDLabelsOnly {
+		values = append(values, dev.Name, dev.Type, dev.Make, dev.Model)
+	}
+	values = append(values, extra...)
+	labels := opts.Devices.Overrides[dev.ID].Labels
+	for _, name := range opts.deviceLabelNames() {
+		values = append(values, labels[name])
+	}
+	return prometheus.MustNewConstMetric(d.desc(opts), valueType, value, values...)
+}
+
+// mergedDevicesTag is the tag in which Sense lists the IDs of the devices
+// that were merged into a device, separated by commas.
+const mergedDevicesTag = "MergedDevices"
+
+// mergedDevices returns the IDs of the devices that were merged into d.
+func mergedDevices(d sense.Device) []string {
+	var ids []string
+	for id := range strings.SplitSeq(d.Tags[mergedDevicesTag], ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// integrationTypeTag is the tag in which Sense names the integration, such as
+// Hue or Kasa, through which it learned about a device.
+const integrationTypeTag = "IntegrationType"
+
+// deviceSource describes how Sense knows about a device.  This depends only
+// on the device list, so that it doesn't change from one scrape to the next.
+// Devices without an integration were detected from their power usage.
+func deviceSource(d sense.Device) string {
+	if d.Tags[integrationTypeTag] != "" {
+		return "integrated"
+	}
+	return "detected"
+}
+
+// formatTags renders a device's tags as a single label value, in the form
+// "key=value,key=value", sorted by key.
+func formatTags(tags map[string]string) string {
+	var b strings.Builder
+	for _, k := range slices.Sorted(maps.Keys(tags)) {
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(tags[k])
+	}
+	return b.String()
+}
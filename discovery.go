@@ -0,0 +1,133 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/dnesting/sense"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	monitorsDesc = prometheus.NewDesc("sense_monitors",
+		"Number of Sense monitors we're collecting from",
+		[]string{}, nil)
+	monitorsAppearedDesc = prometheus.NewDesc("sense_monitors_appeared_total",
+		"Number of monitors that have appeared since we started",
+		[]string{}, nil)
+	monitorsDisappearedDesc = prometheus.NewDesc("sense_monitors_disappeared_total",
+		"Number of monitors that have disappeared since we started",
+		[]string{}, nil)
+)
+
+// RefreshMonitors looks for monitors added to or removed from each account,
+// which Sense only tells us about when we log in.  It uses login to log in to
+// each account again, and if its monitors have changed, replaces the
+// account's client with the new one.
+func (e *Exporter) RefreshMonitors(ctx context.Context, login Reauthenticator) error {
+	e.mu.Lock()
+	clients := e.clients
+	e.mu.Unlock()
+
+	var errs []error
+	for _, cl := range clients {
+		newCl, err := login(ctx, cl)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("account %d: %w", cl.GetAccountID(), err))
+			continue
+		}
+		appeared := monitorsMissing(newCl.GetMonitors(), cl.GetMonitors())
+		disappeared := monitorsMissing(cl.GetMonitors(), newCl.GetMonitors())
+		if len(appeared) == 0 && len(disappeared) == 0 {
+			// Keep the client we have, rather than restart its streams.
+			continue
+		}
+		for _, id := range appeared {
+			log.Printf("account %d: monitor %d appeared", cl.GetAccountID(), id)
+		}
+		for _, id := range disappeared {
+			log.Printf("account %d: monitor %d disappeared", cl.GetAccountID(), id)
+		}
+
+		e.mu.Lock()
+		if slices.Contains(e.clients, cl) {
+			e.monitorsAppeared += len(appeared)
+			e.monitorsDisappeared += len(disappeared)
+			e.replaceClient(cl, newCl)
+		}
+		e.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// monitorsMissing returns the IDs of monitors in a that aren't in b.
+func monitorsMissing(a, b []sense.Monitor) []int {
+	var ids []int
+	for _, m := range a {
+		if !slices.ContainsFunc(b, func(n sense.Monitor) bool { return n.ID == m.ID }) {
+			ids = append(ids, m.ID)
+		}
+	}
+	return ids
+}
+
+// pruneMonitors forgets what we know about monitors we're no longer
+// collecting from.  Energy totals are kept in case the monitor comes back.
+// e.mu must be held.
+func (e *Exporter) pruneMonitors() {
+	mcs, _ := e.monitorClients()
+	have := make(map[monitorKey]bool)
+	for _, mc := range mcs {
+		have[mc.key()] = true
+	}
+	for k := range e.stats {
+		if !have[k] {
+			delete(e.stats, k)
+		}
+	}
+	for k := range e.shared {
+		if !slices.Contains(mcs, k) {
+			delete(e.shared, k)
+		}
+	}
+}
+
+// discoveryCollector reports on the monitors we know about.
+type discoveryCollector struct {
+	e *Exporter
+}
+
+func (c discoveryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- monitorsDesc
+	ch <- monitorsAppearedDesc
+	ch <- monitorsDisappearedDesc
+}
+
+func (c discoveryCollector) Collect(ch chan<- prometheus.Metric) {
+	c.e.mu.Lock()
+	defer c.e.mu.Unlock()
+	monitors := make(map[int]bool)
+	for _, cl := range c.e.clients {
+		for _, m := range cl.GetMonitors() {
+			monitors[m.ID] = true
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(
+		monitorsDesc,
+		prometheus.GaugeValue,
+		float64(len(monitors)),
+	)
+	ch <- prometheus.MustNewConstMetric(
+		monitorsAppearedDesc,
+		prometheus.CounterValue,
+		float64(c.e.monitorsAppeared),
+	)
+	ch <- prometheus.MustNewConstMetric(
+		monitorsDisappearedDesc,
+		prometheus.CounterValue,
+		float64(c.e.monitorsDisappeared),
+	)
+}
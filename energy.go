@@ -0,0 +1,191 @@
+package exporter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dnesting/sense/realtime"
+)
+
+// maxEnergyGap is the longest interval between two realtime updates that we
+// will integrate across.  Beyond this we assume we lost data and don't guess.
+const maxEnergyGap = 30 * time.Second
+
+// energyTotals accumulates the energy, in joules, measured by a monitor,
+// along with how often and for how long each device has been on.
+type energyTotals struct {
+	Monitor       float64            `json:"monitor"`
+	Unidentified  float64            `json:"unidentified,omitempty"`
+	Solar         float64            `json:"solar,omitempty"`
+	GridImport    float64            `json:"grid_import,omitempty"`
+	GridExport    float64            `json:"grid_export,omitempty"`
+	Devices       map[string]float64 `json:"devices"`
+	Activations   map[string]int     `json:"activations,omitempty"`
+	ActiveSeconds map[string]float64 `json:"active_seconds,omitempty"`
+}
+
+func newEnergyTotals() *energyTotals {
+	t := &energyTotals{}
+	t.init()
+	return t
+}
+
+// init creates any maps that are missing, e.g. from an older state file.
+func (t *energyTotals) init() {
+	if t.Devices == nil {
+		t.Devices = make(map[string]float64)
+	}
+	if t.Activations == nil {
+		t.Activations = make(map[string]int)
+	}
+	if t.ActiveSeconds == nil {
+		t.ActiveSeconds = make(map[string]float64)
+	}
+}
+
+func (t *energyTotals) clone() *energyTotals {
+	c := *t
+	c.Devices = maps.Clone(t.Devices)
+	c.Activations = maps.Clone(t.Activations)
+	c.ActiveSeconds = maps.Clone(t.ActiveSeconds)
+	return &c
+}
+
+// add accumulates the power reported by msg as having been drawn for dt.
+func (t *energyTotals) add(msg *realtime.RealtimeUpdate, dt time.Duration) {
+	secs := dt.Seconds()
+	t.Monitor += max(float64(msg.W), 0) * secs
+	t.Solar += max(float64(msg.SolarW), 0) * secs
+	t.GridImport += max(float64(msg.GridW), 0) * secs
+	t.GridExport += max(-float64(msg.GridW), 0) * secs
+	// Whatever Sense doesn't attribute to any device, whether we export it
+	// or not, so that this can't go backwards when options change.
+	unidentified := max(float64(msg.W), 0)
+	for _, d := range msg.Devices {
+		t.Devices[d.ID] += max(float64(d.W), 0) * secs
+		unidentified -= max(float64(d.W), 0)
+	}
+	t.Unidentified += max(unidentified, 0) * secs
+}
+
+// energyFile is the format in which energy totals and device history are
+// persisted, keyed by account and monitor ID, as "account/monitor".  Older
+// files have only energy totals, keyed by monitor ID alone.
+type energyFile struct {
+	Monitors map[string]*energyTotals `json:"monitors"`
+	History  map[string]*savedHistory `json:"device_history,omitempty"`
+}
+
+func (k monitorKey) String() string {
+	return strconv.Itoa(k.account) + "/" + strconv.Itoa(k.monitor)
+}
+
+// parseMonitorKey parses a key written by monitorKey.String.  If s is just a
+// monitor ID, it returns ok false along with the monitor.
+func parseMonitorKey(s string) (k monitorKey, ok bool, err error) {
+	a, m, ok := strings.Cut(s, "/")
+	if !ok {
+		m = a
+	} else if k.account, err = strconv.Atoi(a); err != nil {
+		return k, false, err
+	}
+	k.monitor, err = strconv.Atoi(m)
+	return k, ok, err
+}
+
+// LoadEnergy restores energy totals and device history previously saved with
+// SaveEnergy, so that counters continue from where they left off and devices
+// keep their first-seen times.  A missing file is not an error.  LoadEnergy
+// must be called before Start.
+func (e *Exporter) LoadEnergy(path string) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var f energyFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	mcs, _ := e.monitorClients()
+	e.savedEnergy = make(map[monitorKey]*energyTotals)
+	for s, t := range f.Monitors {
+		k, ok, err := parseMonitorKey(s)
+		if err != nil {
+			return fmt.Errorf("%s: %q: %w", path, s, err)
+		}
+		if !ok {
+			// From an older file, so give them to the first account
+			// we collect this monitor from.
+			i := slices.IndexFunc(mcs, func(mc monitorClient) bool { return mc.monitor == k.monitor })
+			if i < 0 {
+				continue
+			}
+			k = mcs[i].key()
+		}
+		t.init()
+		e.savedEnergy[k] = t
+	}
+	for s, sh := range f.History {
+		k, _, err := parseMonitorKey(s)
+		if err != nil {
+			return fmt.Errorf("%s: %q: %w", path, s, err)
+		}
+		e.monitorStats(k).restoreHistory(sh)
+	}
+	return nil
+}
+
+// SaveEnergy writes the current energy totals and device history for each
+// monitor to path.
+func (e *Exporter) SaveEnergy(path string) error {
+	f := energyFile{
+		Monitors: make(map[string]*energyTotals),
+		History:  make(map[string]*savedHistory),
+	}
+	e.mu.Lock()
+	for k, t := range e.savedEnergy {
+		// A stream may be given these at any moment, so take a copy.
+		f.Monitors[k.String()] = t.clone()
+	}
+	for _, s := range e.streams {
+		f.Monitors[monitorClient{s.cl, s.monitor}.key().String()] = s.energyTotals()
+	}
+	for k, st := range e.stats {
+		if sh := st.saveHistory(); sh != nil {
+			f.History[k.String()] = sh
+		}
+	}
+	e.mu.Unlock()
+
+	b, err := json.Marshal(&f)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so we never leave a truncated file behind.
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,86 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+)
+
+// Reasons a collection from Sense can fail, for sense_scrape_errors_total.
+const (
+	reasonTimeout     = "timeout"
+	reasonAuth        = "auth"
+	reasonNetwork     = "network"
+	reasonProtocol    = "protocol"
+	reasonRateLimited = "rate_limited"
+)
+
+// Stages of a collection from Sense, for sense_scrape_errors_total.
+const (
+	stageDevices = "devices"
+	stageStream  = "stream"
+)
+
+var (
+	errorReasons = []string{reasonTimeout, reasonAuth, reasonNetwork, reasonProtocol, reasonRateLimited}
+	errorStages  = []string{stageDevices, stageStream}
+)
+
+// errStreamTimeout is reported when a stream goes quiet for too long.
+var errStreamTimeout = errors.New("no data received from stream")
+
+// statusCoder is implemented by errors that carry an HTTP status code.
+// Clients should return errors implementing it, possibly wrapped, for
+// failures Sense reported with a status; sense.Client's errors don't, so
+// cmd/sense-exporter wraps it to add them.
+type statusCoder interface {
+	StatusCode() int
+}
+
+// errorStatus returns the HTTP status code carried by err, or 0 if none.
+func errorStatus(err error) int {
+	var sc statusCoder
+	if errors.As(err, &sc) {
+		return sc.StatusCode()
+	}
+	return 0
+}
+
+// isAuthError reports whether err indicates that Sense rejected our
+// credentials.
+func isAuthError(err error) bool {
+	status := errorStatus(err)
+	return status == http.StatusUnauthorized || status == http.StatusForbidden
+}
+
+// isRateLimitedError reports whether err indicates that Sense wants us to
+// slow down.
+func isRateLimitedError(err error) bool {
+	return errorStatus(err) == http.StatusTooManyRequests
+}
+
+// errorReason classifies err, which must not be nil, as one of the reasons
+// above.  Anything we can't otherwise explain is assumed to be Sense sending
+// us something we didn't expect.
+func errorReason(err error) string {
+	var ne net.Error
+	isNet := errors.As(err, &ne)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, errStreamTimeout):
+		return reasonTimeout
+	case errors.Is(err, context.Canceled):
+		// Most likely Prometheus gave up on the scrape.
+		return reasonTimeout
+	case isNet && ne.Timeout():
+		return reasonTimeout
+	case isAuthError(err):
+		return reasonAuth
+	case isRateLimitedError(err):
+		return reasonRateLimited
+	case isNet, errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return reasonNetwork
+	}
+	return reasonProtocol
+}
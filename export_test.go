@@ -0,0 +1,17 @@
+package exporter
+
+import "time"
+
+// SetStreamClock makes s use now for the time messages are received.  It
+// must be called before Run.
+func SetStreamClock(s *Stream, now func() time.Time) {
+	s.now = now
+}
+
+// SetClock makes the streams e starts use now for the time messages are
+// received.  It must be called before Start.
+func SetClock(e *Exporter, now func() time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.now = now
+}
@@ -2,9 +2,12 @@ package exporter
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net/http"
+	"runtime/debug"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/dnesting/sense"
@@ -12,6 +15,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 )
@@ -26,9 +30,29 @@ type Client interface {
 }
 
 type Exporter struct {
-	clients []Client
 	timeout time.Duration
 	colls   []prometheus.Collector
+
+	mu          sync.Mutex
+	clients     []Client
+	opts        Options
+	ctx         context.Context // set by Start
+	streams     []*Stream
+	savedEnergy map[monitorKey]*energyTotals
+	reauth      Reauthenticator
+	accounts    map[int]*accountState
+	stats       map[monitorKey]*scrapeStats
+	sem         chan struct{} // limits concurrent collections; nil if unlimited
+	shared      map[monitorClient]*sharedCollection
+	now         func() time.Time // for new streams
+
+	monitorsAppeared    int
+	monitorsDisappeared int
+
+	// Rebuilt whenever any of the above changes.
+	reg     *prometheus.Registry
+	handler http.Handler
+	probes  map[int]http.Handler // by monitor
 }
 
 var (
@@ -38,11 +62,19 @@ var (
 	scrapeTimeDesc = prometheus.NewDesc("sense_scrape_time_seconds",
 		"Time spent scraping Sense",
 		[]string{}, nil)
+	scrapeErrorsDesc = prometheus.NewDesc("sense_scrape_errors_total",
+		"Number of errors collecting from Sense, by stage and reason",
+		[]string{"stage", "reason"}, nil)
+	lastSuccessDesc = prometheus.NewDesc("sense_last_successful_scrape_timestamp_seconds",
+		"When we last collected data from the Sense monitor successfully",
+		[]string{}, nil)
+	dataAgeDesc = prometheus.NewDesc("sense_data_age_seconds",
+		"How long ago the data being reported was received from the Sense monitor",
+		[]string{}, nil)
 
 	// RealtimeUpdate
-	deviceWattsDesc = prometheus.NewDesc("sense_device_watts",
-		"Current power usage of a device",
-		[]string{"device_id", "name", "type", "make", "model"}, nil)
+	deviceWattsDesc = newDeviceDesc("sense_device_watts",
+		"Current power usage of a device")
 	voltsDesc = prometheus.NewDesc("sense_monitor_volts",
 		"Current voltage detected by the Sense monitor",
 		[]string{"channel"}, nil)
@@ -52,34 +84,243 @@ var (
 	hzDesc = prometheus.NewDesc("sense_monitor_hz",
 		"Current frequency detected by the Sense monitor",
 		[]string{}, nil)
+	channelWattsDesc = prometheus.NewDesc("sense_monitor_channel_watts",
+		"Current power usage detected by the Sense monitor on each channel",
+		[]string{"channel"}, nil)
+	unattributedWattsDesc = prometheus.NewDesc("sense_monitor_unattributed_watts",
+		"Current power usage detected by the Sense monitor but not reported for any exported device",
+		[]string{}, nil)
+	imbalanceDesc = prometheus.NewDesc("sense_monitor_channel_imbalance_ratio",
+		"Difference in power between the most and least loaded channels, as a fraction of the total",
+		[]string{}, nil)
+
+	// RealtimeUpdate, for monitors with solar configured
+	solarWattsDesc = prometheus.NewDesc("sense_monitor_solar_watts",
+		"Current solar power production detected by the Sense monitor",
+		[]string{}, nil)
+	gridWattsDesc = prometheus.NewDesc("sense_monitor_grid_watts",
+		"Current net power drawn from the grid (negative when exporting)",
+		[]string{}, nil)
+	gridImportWattsDesc = prometheus.NewDesc("sense_monitor_grid_import_watts",
+		"Current power drawn from the grid",
+		[]string{}, nil)
+	gridExportWattsDesc = prometheus.NewDesc("sense_monitor_grid_export_watts",
+		"Current power exported to the grid",
+		[]string{}, nil)
 
 	// DeviceStates States[]
-	activeDesc = prometheus.NewDesc("sense_device_active",
-		"Whether a Sense device is active",
-		[]string{"device_id", "name", "type", "make", "model"}, nil)
-	onlineDesc = prometheus.NewDesc("sense_device_online",
-		"Whether a Sense device is online",
-		[]string{"device_id", "name", "type", "make", "model"}, nil)
+	activeDesc = newDeviceDesc("sense_device_active",
+		"Whether a Sense device is active")
+	onlineDesc = newDeviceDesc("sense_device_online",
+		"Whether a Sense device is online")
+
+	// DeviceStates and RealtimeUpdate, when streaming
+	activationsDesc = newDeviceDesc("sense_device_activations_total",
+		"Number of times a device has turned on")
+	activeSecondsDesc = newDeviceDesc("sense_device_active_seconds_total",
+		"Total time a device has been on")
+
+	// Changes between device lists
+	devicesDiscoveredDesc = prometheus.NewDesc("sense_devices_discovered_total",
+		"Number of devices that have appeared in the monitor's device list",
+		[]string{}, nil)
+	devicesRenamedDesc = prometheus.NewDesc("sense_devices_renamed_total",
+		"Number of times a device in the monitor's device list has been renamed",
+		[]string{}, nil)
+	devicesRemovedDesc = prometheus.NewDesc("sense_devices_removed_total",
+		"Number of devices that have disappeared from the monitor's device list",
+		[]string{}, nil)
+	firstSeenDesc = newDeviceDesc("sense_device_first_seen_timestamp_seconds",
+		"When the device first appeared in the monitor's device list")
+
+	// Options.Devices.MaxPerMonitor
+	devicesDroppedDesc = prometheus.NewDesc("sense_devices_dropped",
+		"Number of devices not exported because there were too many",
+		[]string{}, nil)
+
+	// GetMonitors, and Options.Monitors
+	monitorInfoDesc = prometheus.NewDesc("sense_monitor_info",
+		"Descriptive information about a Sense monitor",
+		[]string{"account_id", "serial", "time_zone", "solar_configured", "name"}, nil)
+
+	// GetDevices
+	deviceInfoDesc = &deviceDesc{
+		name: "sense_device_info",
+		help: "Descriptive information about a device",
+		info: true,
+	}
+	mergedIntoDesc = prometheus.NewDesc("sense_device_merged_into",
+		"Identifies the device another was merged into",
+		[]string{"device_id", "parent_id"}, nil)
+
+	// Options.Groups
+	groupWattsDesc = prometheus.NewDesc("sense_group_watts",
+		"Current power usage of the devices in a group",
+		[]string{"group"}, nil)
+	groupEnergyDesc = prometheus.NewDesc("sense_group_energy_joules_total",
+		"Total energy used by the devices currently in a group",
+		[]string{"group"}, nil)
+
+	// Accumulated from every RealtimeUpdate when streaming
+	deviceEnergyDesc = newDeviceDesc("sense_device_energy_joules_total",
+		"Total energy used by a device")
+	energyDesc = prometheus.NewDesc("sense_monitor_energy_joules_total",
+		"Total energy measured by the Sense monitor",
+		[]string{}, nil)
+	solarEnergyDesc = prometheus.NewDesc("sense_monitor_solar_energy_joules_total",
+		"Total solar energy produced",
+		[]string{}, nil)
+	unidentifiedEnergyDesc = prometheus.NewDesc("sense_monitor_unidentified_energy_joules_total",
+		"Total energy measured by the Sense monitor but not identified by Sense as any device's, exported or not",
+		[]string{}, nil)
+	gridImportEnergyDesc = prometheus.NewDesc("sense_monitor_grid_import_energy_joules_total",
+		"Total energy drawn from the grid",
+		[]string{}, nil)
+	gridExportEnergyDesc = prometheus.NewDesc("sense_monitor_grid_export_energy_joules_total",
+		"Total energy exported to the grid",
+		[]string{}, nil)
 )
 
 const traceName = "github.com/dnesting/sense-exporter"
 
+// ServeHTTP collects from every monitor.  Collections aren't tied to the
+// request, since they may be shared with other requests.
 func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	h := e.handler
+	e.mu.Unlock()
+	h.ServeHTTP(w, r)
+}
+
+// Gather collects metrics from every monitor, so that an Exporter can be used
+// as a prometheus.Gatherer.
+func (e *Exporter) Gather() ([]*dto.MetricFamily, error) {
+	e.mu.Lock()
+	reg := e.reg
+	e.mu.Unlock()
+	return reg.Gather()
+}
+
+// rebuild replaces our registries with ones holding collectors for every
+// monitor, after our clients, streams or options change.  Requests already in
+// progress continue to use the previous registries.  e.mu must be held.
+func (e *Exporter) rebuild() {
+	// Collections outlive any one request, so they get their context from
+	// us instead.
+	ctx := e.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	_, dups := e.monitorClients()
+	for _, mc := range dups {
+		if e.opts.DuplicateMonitors == DuplicatesAccountLabel {
+			log.Printf("monitor %d is also accessible to account %d, collecting from both", mc.monitor, mc.cl.GetAccountID())
+		} else {
+			log.Printf("monitor %d is also accessible to account %d, ignoring", mc.monitor, mc.cl.GetAccountID())
+		}
+	}
+
 	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(authCollector{e})
+	reg.MustRegister(discoveryCollector{e})
+	probes := make(map[int]*prometheus.Registry)
+	for _, c := range e.collectors(ctx) {
+		labels := prometheus.Labels{"monitor": strconv.Itoa(c.monitor)}
+		if e.opts.accountLabel() {
+			labels["account"] = strconv.Itoa(c.cl.GetAccountID())
+		}
+		rg := prometheus.WrapRegistererWith(labels, reg)
+		if err := rg.Register(c); err != nil {
+			log.Printf("monitor %d: %v", c.monitor, err)
+			continue
+		}
+		for _, coll := range e.colls {
+			rg.Register(coll)
+		}
+
+		probe, ok := probes[c.monitor]
+		if !ok {
+			probe = prometheus.NewPedanticRegistry()
+			probes[c.monitor] = probe
+		}
+		prometheus.WrapRegistererWith(labels, probe).MustRegister(c)
+	}
+	e.reg = reg
+	e.handler = promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+	e.probes = make(map[int]http.Handler)
+	for id, probe := range probes {
+		e.probes[id] = promhttp.HandlerFor(probe, promhttp.HandlerOpts{})
+	}
+	e.pruneMonitors()
+}
+
+// monitorClient is a monitor we collect from, and the client we use for it.
+type monitorClient struct {
+	cl      Client
+	monitor int
+}
+
+// monitorKey identifies a monitor as seen through a particular account.
+// Unlike monitorClient, it stays the same when we log in to the account
+// again, so it's what we keep per-monitor state under.
+type monitorKey struct {
+	account, monitor int
+}
+
+func (mc monitorClient) key() monitorKey {
+	return monitorKey{mc.cl.GetAccountID(), mc.monitor}
+}
 
-	var colls []prometheus.Collector
+// monitorClients returns the monitors we collect from.  A monitor accessible
+// to more than one client is normally collected from only once, using the
+// first such client, but see Options.DuplicateMonitors.  The duplicates are
+// returned separately, whether we collect from them or not.  e.mu must be
+// held.
+func (e *Exporter) monitorClients() (mcs, dups []monitorClient) {
+	seen := make(map[int]bool)
 	for _, cl := range e.clients {
 		for _, m := range cl.GetMonitors() {
-			c := NewCollector(r.Context(), cl, m.ID, e.timeout)
+			mc := monitorClient{cl, m.ID}
+			if seen[m.ID] {
+				dups = append(dups, mc)
+				if e.opts.DuplicateMonitors != DuplicatesAccountLabel {
+					continue
+				}
+			}
+			seen[m.ID] = true
+			mcs = append(mcs, mc)
+		}
+	}
+	return mcs, dups
+}
+
+// collectors creates a Collector for every monitor.  e.mu must be held.
+func (e *Exporter) collectors(ctx context.Context) []*Collector {
+	// Each Collector gets its own copy of our options, in case they're
+	// replaced while it's collecting.
+	opts := e.opts
+	var colls []*Collector
+	if e.ctx != nil {
+		for _, s := range e.streams {
+			c := NewStreamCollector(s)
+			c.opts = &opts
+			colls = append(colls, c)
+		}
+	} else {
+		mcs, _ := e.monitorClients()
+		for _, mc := range mcs {
+			c := NewCollector(ctx, mc.cl, mc.monitor, opts.timeout(mc.monitor, e.timeout))
+			c.opts = &opts
+			c.onAuth = e.authResult
+			c.stats = e.monitorStats(mc.key())
+			c.sem = e.sem
+			c.shared = e.sharedCollection(mc.cl, mc.monitor)
+			c.minInterval = opts.MinInterval
 			colls = append(colls, c)
-			rg := prometheus.WrapRegistererWith(
-				prometheus.Labels{"monitor": strconv.Itoa(m.ID)},
-				reg)
-			rg.MustRegister(e.colls...)
-			rg.MustRegister(colls...)
 		}
 	}
-	promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	return colls
 }
 
 // Collector handles metrics collection for a specific monitor
@@ -88,6 +329,16 @@ type Collector struct {
 	cl      Client
 	timeout time.Duration
 	monitor int
+	stream  *Stream
+	opts    *Options
+	stats   *scrapeStats
+	sem     chan struct{}
+	onAuth  func(Client, error) // set by Exporter
+
+	// Concurrent collections with the same shared share their results,
+	// which may be reused for up to minInterval.
+	shared      *sharedCollection
+	minInterval time.Duration
 }
 
 // NewCollector creates a new Collector for the specified monitor
@@ -97,35 +348,148 @@ func NewCollector(ctx context.Context, client Client, monitorID int, timeout tim
 		cl:      client,
 		timeout: timeout,
 		monitor: monitorID,
+		opts:    &Options{},
+		stats:   newScrapeStats(),
+	}
+}
+
+// NewStreamCollector creates a new Collector that reports the data most
+// recently received by s, without contacting Sense itself.
+func NewStreamCollector(s *Stream) *Collector {
+	return &Collector{
+		cl:      s.cl,
+		timeout: s.currentTimeout(),
+		monitor: s.monitor,
+		stream:  s,
+		opts:    &Options{},
+		stats:   s.stats,
 	}
 }
 
+// SetOptions changes how c presents its metrics.
+func (c *Collector) SetOptions(opts Options) {
+	c.opts = &opts
+}
+
 func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- upDesc
 	ch <- scrapeTimeDesc
-	ch <- deviceWattsDesc
+	ch <- scrapeErrorsDesc
+	ch <- lastSuccessDesc
+	ch <- dataAgeDesc
+	ch <- monitorInfoDesc
+	ch <- devicesDroppedDesc
+	ch <- devicesDiscoveredDesc
+	ch <- devicesRenamedDesc
+	ch <- devicesRemovedDesc
+	firstSeenDesc.describe(ch, c.opts)
+	deviceWattsDesc.describe(ch, c.opts)
 	ch <- voltsDesc
 	ch <- wattsDesc
 	ch <- hzDesc
-	ch <- activeDesc
-	ch <- onlineDesc
+	ch <- unattributedWattsDesc
+	ch <- channelWattsDesc
+	ch <- imbalanceDesc
+	activeDesc.describe(ch, c.opts)
+	onlineDesc.describe(ch, c.opts)
+	activationsDesc.describe(ch, c.opts)
+	activeSecondsDesc.describe(ch, c.opts)
+	deviceInfoDesc.describe(ch, c.opts)
+	ch <- mergedIntoDesc
+	deviceEnergyDesc.describe(ch, c.opts)
+	ch <- energyDesc
+	ch <- unidentifiedEnergyDesc
+	ch <- solarWattsDesc
+	ch <- gridWattsDesc
+	ch <- gridImportWattsDesc
+	ch <- gridExportWattsDesc
+	ch <- solarEnergyDesc
+	ch <- gridImportEnergyDesc
+	ch <- gridExportEnergyDesc
+	ch <- groupWattsDesc
+	ch <- groupEnergyDesc
 }
 
 func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	if c.opts.enabled(FamilyMonitorInfo) {
+		c.collectInfo(ch)
+	}
+	if c.stream != nil {
+		c.collectStream(ch)
+		return
+	}
+	if c.shared == nil {
+		c.collect(ch)
+		return
+	}
+	metrics := c.shared.do(c.ctx, c.minInterval, func() []prometheus.Metric {
+		// We're collecting on behalf of everyone waiting, so we
+		// mustn't give up just because our own request did.  Our
+		// timeouts bound how long they wait for us instead.
+		leader := *c
+		leader.ctx = context.WithoutCancel(c.ctx)
+		return gather(leader.collect)
+	})
+	for _, m := range metrics {
+		ch <- m
+	}
+}
+
+// collectInfo reports what we know about the monitor without asking Sense.
+func (c *Collector) collectInfo(ch chan<- prometheus.Metric) {
+	m := findMonitor(c.cl, c.monitor)
+	ch <- prometheus.MustNewConstMetric(
+		monitorInfoDesc,
+		prometheus.GaugeValue,
+		1,
+		strconv.Itoa(c.cl.GetAccountID()),
+		m.SerialNumber,
+		m.TimeZone,
+		strconv.FormatBool(m.SolarConfigured),
+		c.opts.Monitors[c.monitor].Name,
+	)
+}
+
+// gather returns the metrics sent by fn.  If fn panics, the panic is logged
+// and gather returns whatever was sent before it, rather than taking down
+// the whole exporter.
+func gather(fn func(chan<- prometheus.Metric)) []prometheus.Metric {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		defer close(ch)
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("panic while collecting: %v\n%s", r, debug.Stack())
+			}
+		}()
+		fn(ch)
+	}()
+	var metrics []prometheus.Metric
+	for m := range ch {
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+// collect collects from Sense.
+func (c *Collector) collect(ch chan<- prometheus.Metric) {
 	log.Println("collecting from monitor", c.monitor)
 	ctx, span := otel.Tracer(traceName).Start(c.ctx, "Collect from Sense Monitor "+strconv.Itoa(c.monitor))
 	defer span.End()
 	span.SetAttributes(attribute.Int("sense-userid", c.cl.GetUserID()))
 	span.SetAttributes(attribute.Int("sense-account", c.cl.GetAccountID()))
 	span.SetAttributes(attribute.Int("sense-monitor", c.monitor))
-	if c.timeout > 0 {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, c.timeout)
-		defer cancel()
-	}
 	start := time.Now()
 	collectOk := 1.0
+	fresh := false
 	defer func() {
+		if collectOk == 1 {
+			c.stats.succeeded(time.Now())
+		}
+		if !fresh {
+			c.collectStale(ch)
+		}
+		c.stats.collect(ch)
 		ch <- prometheus.MustNewConstMetric(
 			upDesc,
 			prometheus.GaugeValue,
@@ -142,120 +506,125 @@ func (c *Collector) Collect(ch chan<- prometheus.Metric) {
 		)
 	}()
 
-	devices, err := c.cl.GetDevices(ctx, c.monitor, false)
+	// The registry runs each Collector in its own goroutine, so this is
+	// the only thing limiting how many monitors we talk to at once.  Our
+	// context outlives the scrape, so we wait at most the monitor's timeout
+	// for our turn, separately from the timeout of the collection itself.
+	if c.sem != nil {
+		wait := ctx
+		if c.timeout > 0 {
+			var cancel context.CancelFunc
+			wait, cancel = context.WithTimeout(ctx, c.timeout)
+			defer cancel()
+		}
+		select {
+		case c.sem <- struct{}{}:
+			defer func() { <-c.sem }()
+		case <-wait.Done():
+			err := fmt.Errorf("waiting to collect: %w", wait.Err())
+			log.Println(err)
+			span.RecordError(err)
+			c.stats.failed(stageDevices, err)
+			collectOk = 0
+			return
+		}
+	}
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	devices, err := c.cl.GetDevices(ctx, c.monitor, c.opts.Devices.IncludeMerged)
+	c.authResult(err)
 	if err != nil {
 		log.Println(err)
 		span.RecordError(err)
+		c.stats.failed(stageDevices, err)
 		collectOk = 0
 		return
 	}
 
-	// Collect basic information about devices. We'll use these in labels later.
-	devInfo := make(map[string]sense.Device)
-	for _, d := range devices {
-		devInfo[d.ID] = d
-	}
-
 	cb := &callbackContainer{
-		ch:      ch,
-		devInfo: devInfo,
+		snap: snapshot{
+			devices: deviceMap(devices),
+			solar:   solarConfigured(c.cl, c.monitor),
+		},
 	}
+	cb.snap.firstSeen = c.stats.sawDevices(c.monitor, cb.snap.devices)
 	err = c.cl.Stream(ctx, c.monitor, cb.callback)
 	if err != nil {
+		c.authResult(err)
 		log.Println(err)
 		span.RecordError(err)
+		c.stats.failed(stageStream, err)
 		collectOk = 0
 	}
+	if cb.snap.realtime == nil {
+		// Nothing new to report.
+		return
+	}
+	fresh = true
+	now := time.Now()
+	c.stats.remember(cb.snap, now)
+	cb.snap.collect(ch, c.opts)
+	dataAge(ch, now)
 }
 
-type callbackContainer struct {
-	gotRealtime bool
-	gotStates   bool
-	ch          chan<- prometheus.Metric
-	devInfo     map[string]sense.Device
+// collectStale reports the last data we collected successfully, if
+// Options.MaxStaleness allows, after we failed to collect anything newer.
+func (c *Collector) collectStale(ch chan<- prometheus.Metric) {
+	snap, at, ok := c.stats.lastSnapshot()
+	if ok && c.opts.serveStale(at) {
+		snap.collect(ch, c.opts)
+		dataAge(ch, at)
+	}
 }
 
-func (e *callbackContainer) callback(ctx context.Context, msg realtime.Message) error {
-	switch msg := msg.(type) {
-
-	case *realtime.RealtimeUpdate:
-		if e.gotRealtime {
-			return nil
-		}
-		for _, d := range msg.Devices {
-			e.ch <- prometheus.MustNewConstMetric(
-				deviceWattsDesc,
-				prometheus.GaugeValue,
-				float64(d.W),
-				d.ID,
-				e.devInfo[d.ID].Name,
-				e.devInfo[d.ID].Type,
-				e.devInfo[d.ID].Make,
-				e.devInfo[d.ID].Model,
-			)
-		}
-		for channel, v := range msg.Voltage {
-			e.ch <- prometheus.MustNewConstMetric(
-				voltsDesc,
-				prometheus.GaugeValue,
-				float64(v),
-				strconv.Itoa(channel),
-			)
-		}
-		e.ch <- prometheus.MustNewConstMetric(
-			wattsDesc,
-			prometheus.GaugeValue,
-			float64(msg.W),
-		)
-		e.ch <- prometheus.MustNewConstMetric(
-			hzDesc,
-			prometheus.GaugeValue,
-			float64(msg.Hz),
-		)
-		e.gotRealtime = true
+// dataAge reports how long ago data received at t was received.
+func dataAge(ch chan<- prometheus.Metric, t time.Time) {
+	ch <- prometheus.MustNewConstMetric(
+		dataAgeDesc,
+		prometheus.GaugeValue,
+		time.Since(t).Seconds(),
+	)
+}
 
-	case *realtime.DeviceStates:
-		if e.gotStates {
-			return nil
-		}
-		for _, d := range msg.States {
-			var active, online float64
-			if d.Mode == "active" {
-				active = 1.0
-			}
-			if d.State == "online" {
-				online = 1.0
-			}
-			e.ch <- prometheus.MustNewConstMetric(
-				activeDesc,
-				prometheus.GaugeValue,
-				active,
-				d.DeviceID,
-				e.devInfo[d.DeviceID].Name,
-				e.devInfo[d.DeviceID].Type,
-				e.devInfo[d.DeviceID].Make,
-				e.devInfo[d.DeviceID].Model,
-			)
-			e.ch <- prometheus.MustNewConstMetric(
-				onlineDesc,
-				prometheus.GaugeValue,
-				online,
-				d.DeviceID,
-				e.devInfo[d.DeviceID].Name,
-				e.devInfo[d.DeviceID].Type,
-				e.devInfo[d.DeviceID].Make,
-				e.devInfo[d.DeviceID].Model,
-			)
-		}
-		e.gotStates = true
+// authResult tells the Exporter, if any, how a call to Sense went.
+func (c *Collector) authResult(err error) {
+	if c.onAuth != nil {
+		c.onAuth(c.cl, err)
 	}
+}
 
-	if e.gotRealtime && e.gotStates {
-		return realtime.Stop
+// collectStream reports the most recent data received by c.stream.
+func (c *Collector) collectStream(ch chan<- prometheus.Metric) {
+	start := time.Now()
+	snap, updated, connected := c.stream.latest()
+	collectOk := 0.0
+	if snap.realtime != nil && (connected || c.opts.serveStale(updated)) {
+		if connected {
+			collectOk = 1.0
+		}
+		snap.collect(ch, c.opts)
+		dataAge(ch, updated)
 	}
-	return nil
+	c.stats.collect(ch)
+	ch <- prometheus.MustNewConstMetric(
+		upDesc,
+		prometheus.GaugeValue,
+		collectOk,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		scrapeTimeDesc,
+		prometheus.GaugeValue,
+		time.Since(start).Seconds(),
+	)
 }
 
+// NewExporter creates an Exporter that collects from every monitor
+// accessible to clients.  By default each scrape connects to the monitors
+// directly; call Start to maintain persistent streams instead.
 func NewExporter(clients []Client, timeout time.Duration) *Exporter {
 	e := &Exporter{
 		clients: clients,
@@ -264,6 +633,130 @@ func NewExporter(clients []Client, timeout time.Duration) *Exporter {
 			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
 			collectors.NewGoCollector(),
 		},
+		savedEnergy: make(map[monitorKey]*energyTotals),
+		accounts:    make(map[int]*accountState),
+		stats:       make(map[monitorKey]*scrapeStats),
+		shared:      make(map[monitorClient]*sharedCollection),
+		now:         time.Now,
 	}
+	e.rebuild()
 	return e
 }
+
+// SetOptions changes how the Exporter presents its metrics.  Requests already
+// in progress continue to use the previous options.
+func (e *Exporter) SetOptions(opts Options) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.setOptions(opts)
+	if e.ctx != nil {
+		// Which monitors we stream from depends on DuplicateMonitors.
+		e.syncStreams()
+	}
+	e.rebuild()
+}
+
+// setOptions replaces our options.  e.mu must be held, and the caller must
+// rebuild.
+func (e *Exporter) setOptions(opts Options) {
+	e.opts = opts
+	if opts.MaxConcurrency != cap(e.sem) {
+		// Collections already in progress hold on to the old semaphore,
+		// so for a while we might exceed the new limit.
+		e.sem = nil
+		if opts.MaxConcurrency > 0 {
+			e.sem = make(chan struct{}, opts.MaxConcurrency)
+		}
+	}
+}
+
+// SetClients replaces the clients the Exporter collects from.  Streams for
+// clients that remain are left running, streams for clients that were removed
+// are stopped, and streams are started for any new clients.  Requests already
+// in progress continue to use the previous clients.
+func (e *Exporter) SetClients(clients []Client) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.clients = clients
+	if e.ctx != nil {
+		e.syncStreams()
+	}
+	e.rebuild()
+}
+
+// Reconfigure replaces the options and the clients, as SetOptions and
+// SetClients do, along with the timeout given to NewExporter, but all at
+// once, so that no request sees the new options with the old clients or the
+// other way around.  Running streams pick up the new timeout without being
+// restarted.
+func (e *Exporter) Reconfigure(opts Options, clients []Client, timeout time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.setOptions(opts)
+	e.clients = clients
+	e.timeout = timeout
+	if e.ctx != nil {
+		e.syncStreams()
+	}
+	e.rebuild()
+}
+
+// Start opens a persistent Stream to each monitor, after which ServeHTTP
+// answers from the data received by these streams rather than connecting to
+// Sense for each request.  The streams run until ctx is canceled.  Start must
+// be called before the Exporter begins serving requests.
+func (e *Exporter) Start(ctx context.Context) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.ctx = ctx
+	e.syncStreams()
+	e.rebuild()
+}
+
+// syncStreams ensures that we have exactly one stream running for each
+// monitor we collect from.  e.mu must be held.
+func (e *Exporter) syncStreams() {
+	mcs, _ := e.monitorClients()
+	want := make(map[monitorClient]bool)
+	for _, mc := range mcs {
+		want[mc] = true
+	}
+
+	var streams []*Stream
+	have := make(map[monitorClient]bool)
+	for _, s := range e.streams {
+		k := monitorClient{s.cl, s.monitor}
+		if want[k] {
+			// These can change without restarting the stream.
+			s.setTimeout(e.opts.timeout(s.monitor, e.timeout))
+			s.setIncludeMerged(e.opts.Devices.IncludeMerged)
+			streams = append(streams, s)
+			have[k] = true
+			continue
+		}
+		log.Println("stopping stream for monitor", s.monitor)
+		s.stop()
+		// Hold on to the energy totals in case the monitor comes back.
+		e.savedEnergy[k.key()] = s.energyTotals()
+	}
+	for _, mc := range mcs {
+		if have[mc] {
+			continue
+		}
+		have[mc] = true
+		s := NewStream(mc.cl, mc.monitor, e.opts.timeout(mc.monitor, e.timeout))
+		if t, ok := e.savedEnergy[mc.key()]; ok {
+			s.energy = t
+			delete(e.savedEnergy, mc.key())
+		}
+		ctx, cancel := context.WithCancel(e.ctx)
+		s.stop = cancel
+		s.onAuth = e.authResult
+		s.now = e.now
+		s.stats = e.monitorStats(mc.key())
+		s.includeMerged = e.opts.Devices.IncludeMerged
+		streams = append(streams, s)
+		go s.Run(ctx)
+	}
+	e.streams = streams
+}
@@ -1,9 +1,22 @@
 package exporter_test
 
 import (
+	"cmp"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -24,6 +37,14 @@ type mockDevice struct {
 	Watts  float32
 	Active bool
 	Online bool
+
+	// MergedInto is the ID of the device this was merged into.  Merged
+	// devices are only returned by GetDevices when asked for, and don't
+	// appear in the stream.
+	MergedInto string
+	// Integration, if set, is the integration through which Sense knows
+	// about the device.
+	Integration string
 }
 
 // mockClient implements the exporter.Client interface for testing
@@ -34,11 +55,92 @@ type mockClient struct {
 	devices    []mockDevice
 	devicesErr error
 	streamErr  error
+	// devicesPanic makes GetDevices panic.
+	devicesPanic bool
+
+	// stayConnected keeps Stream open after sending its messages, as a
+	// real monitor would.
+	stayConnected bool
+	// updateInterval, if set, repeats the realtime update at this interval
+	// while stayConnected.
+	updateInterval time.Duration
+	// messages, if set, are passed to the callback as they arrive while
+	// stayConnected.  A nil message closes the stream.
+	messages chan realtime.Message
+
+	// inFlight, if set, counts calls to GetDevices in progress, each of
+	// which takes a little while.
+	inFlight *inFlight
+
+	// streams counts calls to Stream.
+	streams atomic.Int32
 
 	// Monitor-level data
 	totalWatts float32
 	hz         float32
 	voltages   []float32
+	channels   []float32
+	solarWatts float32
+	gridWatts  float32
+}
+
+// inFlight tracks how many calls are in progress, the most seen at once, and
+// how many there have been in total.
+type inFlight struct {
+	mu            sync.Mutex
+	n, max, total int
+}
+
+func (f *inFlight) enter() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.n++
+	f.max = max(f.max, f.n)
+	f.total++
+}
+
+func (f *inFlight) exit() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.n--
+}
+
+// fakeClock is a clock that only moves when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// updateStream delivers msg n times to a stream reading from client.messages,
+// advancing clock by dt before each, and returns once they've been handled.
+// The stream integrates power over the time between updates, so this adds
+// n*dt of msg's power on top of anything before it.
+func updateStream(client *mockClient, clock *fakeClock, msg realtime.Message, n int, dt time.Duration) {
+	// Each message is taken once the previous one has been handled, so
+	// repeating msg without advancing the clock waits without adding
+	// anything.
+	client.messages <- msg
+	for range n {
+		clock.Advance(dt)
+		client.messages <- msg
+	}
+	client.messages <- msg
 }
 
 func (m *mockClient) GetUserID() int {
@@ -50,24 +152,50 @@ func (m *mockClient) GetAccountID() int {
 }
 
 func (m *mockClient) GetDevices(ctx context.Context, monitor int, includeMerged bool) ([]sense.Device, error) {
+	if m.inFlight != nil {
+		m.inFlight.enter()
+		defer m.inFlight.exit()
+		time.Sleep(50 * time.Millisecond)
+	}
+	if m.devicesPanic {
+		panic("GetDevices")
+	}
 	if m.devicesErr != nil {
 		return nil, m.devicesErr
 	}
 
 	var devices []sense.Device
 	for _, d := range m.devices {
+		if d.MergedInto != "" && !includeMerged {
+			continue
+		}
+		var merged []string
+		for _, c := range m.devices {
+			if c.MergedInto == d.ID {
+				merged = append(merged, c.ID)
+			}
+		}
+		var tags map[string]string
+		if len(merged) > 0 {
+			tags = map[string]string{"MergedDevices": strings.Join(merged, ",")}
+		}
+		if d.Integration != "" {
+			tags = map[string]string{"IntegrationType": d.Integration}
+		}
 		devices = append(devices, sense.Device{
 			ID:    d.ID,
 			Name:  d.Name,
 			Type:  d.Type,
 			Make:  d.Make,
 			Model: d.Model,
+			Tags:  tags,
 		})
 	}
 	return devices, nil
 }
 
 func (m *mockClient) Stream(ctx context.Context, monitor int, callback realtime.Callback) error {
+	m.streams.Add(1)
 	if m.streamErr != nil {
 		return m.streamErr
 	}
@@ -75,6 +203,9 @@ func (m *mockClient) Stream(ctx context.Context, monitor int, callback realtime.
 	// Create realtime update with device power data
 	var realtimeDevices []realtime.Device
 	for _, d := range m.devices {
+		if d.MergedInto != "" {
+			continue
+		}
 		realtimeDevices = append(realtimeDevices, realtime.Device{
 			ID: d.ID,
 			W:  d.Watts,
@@ -82,15 +213,21 @@ func (m *mockClient) Stream(ctx context.Context, monitor int, callback realtime.
 	}
 
 	realtimeUpdate := &realtime.RealtimeUpdate{
-		W:       m.totalWatts,
-		Hz:      m.hz,
-		Voltage: m.voltages,
-		Devices: realtimeDevices,
+		W:        m.totalWatts,
+		Hz:       m.hz,
+		Voltage:  m.voltages,
+		Channels: m.channels,
+		Devices:  realtimeDevices,
+		SolarW:   m.solarWatts,
+		GridW:    m.gridWatts,
 	}
 
 	// Create device states
 	var deviceStates []realtime.DeviceState
 	for _, d := range m.devices {
+		if d.MergedInto != "" {
+			continue
+		}
 		mode := "inactive"
 		if d.Active {
 			mode = "active"
@@ -125,6 +262,31 @@ func (m *mockClient) Stream(ctx context.Context, monitor int, callback realtime.
 		return err
 	}
 
+	if m.stayConnected {
+		var tick <-chan time.Time
+		if m.updateInterval > 0 {
+			t := time.NewTicker(m.updateInterval)
+			defer t.Stop()
+			tick = t.C
+		}
+		for {
+			var err error
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-tick:
+				err = callback(ctx, realtimeUpdate)
+			case msg := <-m.messages:
+				if msg == nil {
+					return nil
+				}
+				err = callback(ctx, msg)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
@@ -132,6 +294,15 @@ func (m *mockClient) GetMonitors() []sense.Monitor {
 	return append([]sense.Monitor{}, m.monitors...)
 }
 
+// labels returns the labels of m as a map.
+func labels(m *dto.Metric) map[string]string {
+	l := make(map[string]string)
+	for _, lp := range m.GetLabel() {
+		l[lp.GetName()] = lp.GetValue()
+	}
+	return l
+}
+
 // Helper function to collect metrics from a collector
 func collectMetrics(t *testing.T, collector *exporter.Collector) map[string][]*dto.Metric {
 	ch := make(chan prometheus.Metric, 100)
@@ -149,25 +320,10 @@ func collectMetrics(t *testing.T, collector *exporter.Collector) map[string][]*d
 			t.Fatalf("Failed to write metric: %v", err)
 		}
 
-		desc := metric.Desc()
-		descStr := desc.String()
-
-		var metricName string
-		if strings.Contains(descStr, `fqName: "sense_monitor_up"`) {
-			metricName = "sense_monitor_up"
-		} else if strings.Contains(descStr, `fqName: "sense_scrape_time_seconds"`) {
-			metricName = "sense_scrape_time_seconds"
-		} else if strings.Contains(descStr, `fqName: "sense_monitor_watts"`) {
-			metricName = "sense_monitor_watts"
-		} else if strings.Contains(descStr, `fqName: "sense_monitor_hz"`) {
-			metricName = "sense_monitor_hz"
-		} else if strings.Contains(descStr, `fqName: "sense_monitor_volts"`) {
-			metricName = "sense_monitor_volts"
-		} else if strings.Contains(descStr, `fqName: "sense_device_watts"`) {
-			metricName = "sense_device_watts"
-		} else {
-			continue // Skip other metrics
-		}
+		// Desc doesn't expose the metric name, so dig it out of the string.
+		descStr := metric.Desc().String()
+		_, metricName, _ := strings.Cut(descStr, `fqName: "`)
+		metricName, _, _ = strings.Cut(metricName, `"`)
 
 		metricsByName[metricName] = append(metricsByName[metricName], dto)
 	}
@@ -205,8 +361,6 @@ func verifyMetricValue(t *testing.T, metrics map[string][]*dto.Metric, metricNam
 	}
 }
 
-
-
 // extractDeviceWattsByID extracts device watts metrics and returns a map of deviceID -> watts
 func extractDeviceWattsByID(t *testing.T, deviceWattsMetrics []*dto.Metric) map[string]float64 {
 	deviceWattsByID := make(map[string]float64)
@@ -430,3 +584,1517 @@ func TestCollectorWithDevices(t *testing.T) {
 		}
 	}
 }
+
+func TestStreamCollector(t *testing.T) {
+	client := &mockClient{
+		userID:    123,
+		accountID: 456,
+		devices: []mockDevice{
+			{ID: "light1", Name: "Living Room Light", Type: "Light", Make: "Philips", Model: "Hue", Watts: 25.5, Active: true, Online: true},
+		},
+		totalWatts:    25.5,
+		hz:            60.0,
+		voltages:      []float32{120.0, 119.5},
+		stayConnected: true,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := exporter.NewStream(client, 789, time.Second)
+	go stream.Run(ctx)
+
+	collector := exporter.NewStreamCollector(stream)
+
+	// Wait for the stream to deliver its first update.
+	var metrics map[string][]*dto.Metric
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		metrics = collectMetrics(t, collector)
+		if metrics["sense_monitor_up"][0].GetGauge().GetValue() == 1.0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for stream to connect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	verifyMetricValue(t, metrics, "sense_monitor_watts", 25.5)
+	verifyMetricValue(t, metrics, "sense_monitor_hz", 60.0)
+	deviceWattsByID := extractDeviceWattsByID(t, metrics["sense_device_watts"])
+	if deviceWattsByID["light1"] != 25.5 {
+		t.Errorf("Expected device light1 watts=25.5, got %.1f", deviceWattsByID["light1"])
+	}
+
+	// Once the stream is shut down, the monitor should be reported as down.
+	cancel()
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		metrics = collectMetrics(t, collector)
+		if metrics["sense_monitor_up"][0].GetGauge().GetValue() == 0.0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for stream to disconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	verifyMetricsMissing(t, metrics, []string{
+		"sense_monitor_watts",
+		"sense_device_watts",
+	})
+}
+
+func TestStreamEnergy(t *testing.T) {
+	client := &mockClient{
+		userID:    123,
+		accountID: 456,
+		monitors:  []sense.Monitor{{ID: 789}},
+		devices: []mockDevice{
+			{ID: "light1", Name: "Living Room Light", Watts: 1000},
+		},
+		totalWatts:    1000,
+		stayConnected: true,
+		messages:      make(chan realtime.Message),
+	}
+
+	// Start with some energy saved from a previous run.
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	saved := `{"monitors":{"789":{"monitor":5000,"devices":{"light1":3000,"old1":20}}}}`
+	if err := os.WriteFile(stateFile, []byte(saved), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := exporter.NewExporter([]exporter.Client{client}, time.Second)
+	if err := exp.LoadEnergy(stateFile); err != nil {
+		t.Fatalf("LoadEnergy: %v", err)
+	}
+	clock := newFakeClock()
+	exporter.SetClock(exp, clock.Now)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	exp.Start(ctx)
+	waitForScrape(t, exp, `sense_monitor_watts{monitor="789"} 1000`)
+
+	// Each update's power is integrated over the time until the next one,
+	// on top of what was saved: 1000W for 200ms is 200J.
+	update := &realtime.RealtimeUpdate{W: 1000, Devices: []realtime.Device{{ID: "light1", W: 1000}}}
+	for range 2 {
+		clock.Advance(100 * time.Millisecond)
+		client.messages <- update
+	}
+	client.messages <- &realtime.DeviceStates{} // wait for the last update
+	if err := exp.SaveEnergy(stateFile); err != nil {
+		t.Fatalf("SaveEnergy: %v", err)
+	}
+	b, err := os.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state struct {
+		Monitors map[string]struct {
+			Monitor float64
+			Devices map[string]float64
+		}
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		t.Fatal(err)
+	}
+	// Totals from an older file, keyed by monitor alone, are saved under the
+	// account as well.
+	m := state.Monitors["456/789"]
+	if math.Abs(m.Monitor-5200) > 1e-6 {
+		t.Errorf("Expected monitor energy 5200, got %.1f", m.Monitor)
+	}
+	if math.Abs(m.Devices["light1"]-3200) > 1e-6 {
+		t.Errorf("Expected light1 energy 3200, got %.1f", m.Devices["light1"])
+	}
+	if m.Devices["old1"] != 20 {
+		t.Errorf("Expected old1 energy to be preserved as 20, got %.1f", m.Devices["old1"])
+	}
+
+	// Counters should be reported for every device we know about.
+	body := scrape(t, exp)
+	for _, id := range []string{"light1", "old1"} {
+		if !strings.Contains(body, `sense_device_energy_joules_total{device_id="`+id+`"`) {
+			t.Errorf("Expected energy for %s:\n%s", id, body)
+		}
+	}
+}
+
+func TestCollectorSolar(t *testing.T) {
+	client := &mockClient{
+		userID:     123,
+		accountID:  456,
+		monitors:   []sense.Monitor{{ID: 789, SolarConfigured: true}},
+		totalWatts: 1500,
+		solarWatts: 2000,
+		gridWatts:  -500,
+	}
+
+	collector := exporter.NewCollector(context.Background(), client, 789, time.Second)
+	metrics := collectMetrics(t, collector)
+
+	verifyMetricValue(t, metrics, "sense_monitor_up", 1.0)
+	verifyMetricValue(t, metrics, "sense_monitor_solar_watts", 2000)
+	verifyMetricValue(t, metrics, "sense_monitor_grid_watts", -500)
+	verifyMetricValue(t, metrics, "sense_monitor_grid_import_watts", 0)
+	verifyMetricValue(t, metrics, "sense_monitor_grid_export_watts", 500)
+
+	// Monitors without solar shouldn't report solar metrics at all.
+	client.monitors[0].SolarConfigured = false
+	metrics = collectMetrics(t, collector)
+	verifyMetricsMissing(t, metrics, []string{
+		"sense_monitor_solar_watts",
+		"sense_monitor_grid_watts",
+		"sense_monitor_grid_import_watts",
+		"sense_monitor_grid_export_watts",
+	})
+}
+
+func TestCollectorChannels(t *testing.T) {
+	client := &mockClient{
+		userID:     123,
+		accountID:  456,
+		totalWatts: 1000,
+		voltages:   []float32{120.0, 119.5},
+		channels:   []float32{700, 300},
+	}
+
+	collector := exporter.NewCollector(context.Background(), client, 789, time.Second)
+	metrics := collectMetrics(t, collector)
+
+	channelWatts := make(map[string]float64)
+	for _, m := range metrics["sense_monitor_channel_watts"] {
+		for _, l := range m.GetLabel() {
+			if l.GetName() == "channel" {
+				channelWatts[l.GetValue()] = m.GetGauge().GetValue()
+			}
+		}
+	}
+	if len(channelWatts) != 2 || channelWatts["0"] != 700 || channelWatts["1"] != 300 {
+		t.Errorf("Expected channel watts {0:700, 1:300}, got %v", channelWatts)
+	}
+	verifyMetricValue(t, metrics, "sense_monitor_channel_imbalance_ratio", 0.4)
+
+	// With nothing drawing power, the ratio is meaningless.
+	client.channels = []float32{0, 0}
+	metrics = collectMetrics(t, collector)
+	verifyMetricsMissing(t, metrics, []string{"sense_monitor_channel_imbalance_ratio"})
+}
+
+func TestCollectorDeviceInfo(t *testing.T) {
+	client := &mockClient{
+		userID:    123,
+		accountID: 456,
+		devices: []mockDevice{
+			{ID: "light1", Name: "Living Room Light", Type: "Light", Make: "Philips", Model: "Hue", Watts: 25.5, Active: true, Online: true, Integration: "Hue"},
+			{ID: "motor3", Name: "Motor 3", Type: "Motor", Watts: 300},
+		},
+		totalWatts: 325.5,
+	}
+
+	collector := exporter.NewCollector(context.Background(), client, 789, time.Second)
+	collector.SetOptions(exporter.Options{DeviceIDLabelsOnly: true})
+	metrics := collectMetrics(t, collector)
+
+	info := make(map[string]map[string]string)
+	for _, m := range metrics["sense_device_info"] {
+		info[labels(m)["device_id"]] = labels(m)
+	}
+	if len(info) != 2 {
+		t.Fatalf("Expected 2 sense_device_info metrics, got %d", len(info))
+	}
+	want := map[string]string{
+		"device_id": "light1",
+		"name":      "Living Room Light",
+		"type":      "Light",
+		"make":      "Philips",
+		"model":     "Hue",
+		"icon":      "",
+		"tags":      "IntegrationType=Hue",
+		"source":    "integrated",
+	}
+	if got := info["light1"]; !maps.Equal(got, want) {
+		t.Errorf("Expected sense_device_info labels %v, got %v", want, got)
+	}
+	// Whether a device reports states doesn't matter, since that can
+	// change from one scrape to the next.
+	if got := info["motor3"]["source"]; got != "detected" {
+		t.Errorf("Expected motor3 to have source detected, got %q", got)
+	}
+
+	for _, name := range []string{"sense_device_watts", "sense_device_active", "sense_device_online"} {
+		for _, m := range metrics[name] {
+			if got := slices.Collect(maps.Keys(labels(m))); !slices.Equal(got, []string{"device_id"}) {
+				t.Errorf("Expected %s to be labeled with only device_id, got %v", name, got)
+			}
+		}
+	}
+
+	// A registry insists that every series of a metric has the same
+	// labels, whichever way we label them.
+	for _, slim := range []bool{false, true} {
+		collector := exporter.NewCollector(context.Background(), client, 789, time.Second)
+		collector.SetOptions(exporter.Options{DeviceIDLabelsOnly: slim})
+		reg := prometheus.NewPedanticRegistry()
+		if err := reg.Register(collector); err != nil {
+			t.Fatalf("DeviceIDLabelsOnly=%v: %v", slim, err)
+		}
+		if _, err := reg.Gather(); err != nil {
+			t.Errorf("DeviceIDLabelsOnly=%v: %v", slim, err)
+		}
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	opts := exporter.Options{
+		Monitors: map[int]exporter.MonitorOptions{789: {Timeout: -time.Second}},
+		Devices: exporter.DeviceOptions{
+			Exclude: []exporter.DeviceRule{{ID: "light1"}, {}},
+		},
+		Metrics:           map[string]bool{"bogus": false},
+		MaxConcurrency:    -1,
+		MinInterval:       -time.Second,
+		MaxStaleness:      -time.Second,
+		DuplicateMonitors: "bogus",
+	}
+	err := opts.Validate()
+	if err == nil {
+		t.Fatal("Expected validation to fail")
+	}
+	for _, key := range []string{"max-concurrency", "min-interval", "max-staleness", "duplicate-monitors", "monitors.789.timeout", "devices.exclude[1]", "metrics.bogus"} {
+		if !strings.Contains(err.Error(), key+":") {
+			t.Errorf("Expected error to mention %s, got: %v", key, err)
+		}
+	}
+	if strings.Contains(err.Error(), "devices.exclude[0]") {
+		t.Errorf("Expected devices.exclude[0] to be valid, got: %v", err)
+	}
+}
+
+func TestCollectorOptions(t *testing.T) {
+	client := &mockClient{
+		userID:    123,
+		accountID: 456,
+		devices: []mockDevice{
+			{ID: "light1", Name: "Living Room Light", Type: "Light", Make: "Philips", Model: "Hue", Watts: 25.5, Active: true, Online: true},
+			{ID: "motor3", Name: "Motor 3", Type: "Motor", Watts: 300},
+		},
+		totalWatts: 325.5,
+		hz:         60.0,
+		voltages:   []float32{120.0, 119.5},
+	}
+
+	opts := exporter.Options{
+		Devices: exporter.DeviceOptions{
+			Exclude:   []exporter.DeviceRule{{ID: "motor3"}},
+			Overrides: map[string]exporter.DeviceOverride{"light1": {Name: "Lamp"}},
+		},
+		Metrics: map[string]bool{exporter.FamilyMonitor: false},
+	}
+	if err := opts.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	collector := exporter.NewCollector(context.Background(), client, 789, time.Second)
+	collector.SetOptions(opts)
+	metrics := collectMetrics(t, collector)
+
+	verifyMetricValue(t, metrics, "sense_monitor_up", 1.0)
+	verifyMetricsMissing(t, metrics, []string{
+		"sense_monitor_watts",
+		"sense_monitor_hz",
+		"sense_monitor_volts",
+	})
+
+	deviceWatts := metrics["sense_device_watts"]
+	if len(deviceWatts) != 1 {
+		t.Fatalf("Expected 1 device watts metric, got %d", len(deviceWatts))
+	}
+	for _, l := range deviceWatts[0].GetLabel() {
+		if l.GetName() == "device_id" && l.GetValue() != "light1" {
+			t.Errorf("Expected only light1 to be exported, got %s", l.GetValue())
+		}
+		if l.GetName() == "name" && l.GetValue() != "Lamp" {
+			t.Errorf("Expected light1 to be named Lamp, got %s", l.GetValue())
+		}
+	}
+}
+
+// scrape fetches metrics from exp as text.
+func scrape(t *testing.T, exp *exporter.Exporter) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	exp.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	return rec.Body.String()
+}
+
+// waitForScrape scrapes exp until the output contains want.
+func waitForScrape(t *testing.T, exp *exporter.Exporter, want string) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		body := scrape(t, exp)
+		if strings.Contains(body, want) {
+			return body
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %q in:\n%s", want, body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestExporterSetClients(t *testing.T) {
+	client1 := &mockClient{
+		accountID:     1,
+		monitors:      []sense.Monitor{{ID: 100}},
+		totalWatts:    100,
+		stayConnected: true,
+	}
+	client2 := &mockClient{
+		accountID:     2,
+		monitors:      []sense.Monitor{{ID: 200}},
+		totalWatts:    200,
+		stayConnected: true,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	exp := exporter.NewExporter([]exporter.Client{client1}, time.Second)
+	exp.Start(ctx)
+	waitForScrape(t, exp, `sense_monitor_watts{monitor="100"} 100`)
+
+	// Adding a client starts streaming from its monitors.
+	exp.SetClients([]exporter.Client{client1, client2})
+	body := waitForScrape(t, exp, `sense_monitor_watts{monitor="200"} 200`)
+	if !strings.Contains(body, `sense_monitor_up{monitor="100"} 1`) {
+		t.Errorf("Expected monitor 100 to remain up:\n%s", body)
+	}
+
+	// Removing a client stops reporting its monitors.
+	exp.SetClients([]exporter.Client{client2})
+	body = scrape(t, exp)
+	if strings.Contains(body, `monitor="100"`) {
+		t.Errorf("Expected monitor 100 to be gone:\n%s", body)
+	}
+	if !strings.Contains(body, `sense_monitor_up{monitor="200"} 1`) {
+		t.Errorf("Expected monitor 200 to remain up:\n%s", body)
+	}
+}
+
+func TestExporterReconfigure(t *testing.T) {
+	client1 := &mockClient{
+		accountID:     1,
+		monitors:      []sense.Monitor{{ID: 100}},
+		totalWatts:    100,
+		stayConnected: true,
+	}
+	client2 := &mockClient{
+		accountID:     2,
+		monitors:      []sense.Monitor{{ID: 200}},
+		totalWatts:    200,
+		stayConnected: true,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	exp := exporter.NewExporter([]exporter.Client{client1}, time.Second)
+	exp.Start(ctx)
+	waitForScrape(t, exp, `sense_monitor_watts{monitor="100"} 100`)
+
+	// New options and clients take effect together.
+	exp.Reconfigure(exporter.Options{AccountLabel: true}, []exporter.Client{client2}, time.Second)
+	body := waitForScrape(t, exp, `sense_monitor_watts{account="2",monitor="200"} 200`)
+	if strings.Contains(body, `monitor="100"`) {
+		t.Errorf("Expected monitor 100 to be gone:\n%s", body)
+	}
+}
+
+func TestExporterReauth(t *testing.T) {
+	rejected := &mockClient{
+		accountID:  1,
+		monitors:   []sense.Monitor{{ID: 100}},
+		devicesErr: statusError(http.StatusUnauthorized),
+	}
+	good := &mockClient{
+		accountID:  1,
+		monitors:   []sense.Monitor{{ID: 100}},
+		totalWatts: 100,
+	}
+
+	exp := exporter.NewExporter([]exporter.Client{rejected}, time.Second)
+	reauthed := make(chan exporter.Client, 1)
+	release := make(chan struct{})
+	exp.SetReauthenticator(func(ctx context.Context, cl exporter.Client) (exporter.Client, error) {
+		reauthed <- cl
+		<-release
+		return good, nil
+	})
+
+	body := scrape(t, exp)
+	if !strings.Contains(body, `sense_monitor_up{monitor="100"} 0`) {
+		t.Errorf("Expected monitor 100 to be down:\n%s", body)
+	}
+
+	select {
+	case cl := <-reauthed:
+		if cl != rejected {
+			t.Errorf("Expected to log in again for the rejected client, got %v", cl)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting to log in again")
+	}
+	body = scrape(t, exp)
+	if !strings.Contains(body, `sense_account_authenticated{account="1"} 0`) {
+		t.Errorf("Expected account 1 to be unauthenticated:\n%s", body)
+	}
+	close(release)
+
+	// The new client replaces the rejected one.
+	body = waitForScrape(t, exp, `sense_monitor_watts{monitor="100"} 100`)
+	if !strings.Contains(body, `sense_account_authenticated{account="1"} 1`) {
+		t.Errorf("Expected account 1 to be authenticated:\n%s", body)
+	}
+	if strings.Contains(body, `sense_account_auth_failures_total{account="1"} 0`) {
+		t.Errorf("Expected auth failures to be counted:\n%s", body)
+	}
+}
+
+// timeoutError is a net.Error reporting a timeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// statusError is an error carrying an HTTP status code.
+type statusError int
+
+func (e statusError) Error() string   { return http.StatusText(int(e)) }
+func (e statusError) StatusCode() int { return int(e) }
+
+func TestCollectorScrapeErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		client     *mockClient
+		wantStage  string
+		wantReason string
+	}{
+		{"devices timeout", &mockClient{devicesErr: fmt.Errorf("get devices: %w", context.DeadlineExceeded)}, "devices", "timeout"},
+		{"devices auth", &mockClient{devicesErr: fmt.Errorf("get devices: %w", statusError(http.StatusUnauthorized))}, "devices", "auth"},
+		{"devices rate limited", &mockClient{devicesErr: statusError(http.StatusTooManyRequests)}, "devices", "rate_limited"},
+		{"devices unauthorized text", &mockClient{devicesErr: errors.New("401 Unauthorized")}, "devices", "protocol"},
+		{"stream network", &mockClient{streamErr: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, "stream", "network"},
+		{"stream network timeout", &mockClient{streamErr: &net.OpError{Op: "read", Err: timeoutError{}}}, "stream", "timeout"},
+		{"stream protocol", &mockClient{streamErr: errors.New("unexpected message")}, "stream", "protocol"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := exporter.NewCollector(context.Background(), tt.client, 789, time.Second)
+			metrics := collectMetrics(t, collector)
+
+			errs := metrics["sense_scrape_errors_total"]
+			if len(errs) != 10 {
+				t.Errorf("Expected a counter for every stage and reason, got %d", len(errs))
+			}
+			for _, m := range errs {
+				labels := make(map[string]string)
+				for _, l := range m.GetLabel() {
+					labels[l.GetName()] = l.GetValue()
+				}
+				want := 0.0
+				if labels["stage"] == tt.wantStage && labels["reason"] == tt.wantReason {
+					want = 1
+				}
+				if got := m.GetCounter().GetValue(); got != want {
+					t.Errorf("sense_scrape_errors_total%v = %v, want %v", labels, got, want)
+				}
+			}
+			verifyMetricsMissing(t, metrics, []string{"sense_last_successful_scrape_timestamp_seconds"})
+		})
+	}
+
+	// A successful scrape records when it happened.
+	before := time.Now()
+	collector := exporter.NewCollector(context.Background(), &mockClient{}, 789, time.Second)
+	metrics := collectMetrics(t, collector)
+	ts := metrics["sense_last_successful_scrape_timestamp_seconds"]
+	if len(ts) != 1 {
+		t.Fatalf("Expected sense_last_successful_scrape_timestamp_seconds, got %v", ts)
+	}
+	if got := ts[0].GetGauge().GetValue(); got < float64(before.Unix()) {
+		t.Errorf("Expected last successful scrape after %v, got %v", before, got)
+	}
+}
+
+func TestStreamClosed(t *testing.T) {
+	client := &mockClient{
+		monitors:      []sense.Monitor{{ID: 789}},
+		totalWatts:    100,
+		stayConnected: true,
+		messages:      make(chan realtime.Message),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := exporter.NewStream(client, 789, time.Minute)
+	go stream.Run(ctx)
+
+	// waitStreams waits for Stream to have been called n times.
+	waitStreams := func(n int32, timeout time.Duration) {
+		t.Helper()
+		deadline := time.Now().Add(timeout)
+		for client.streams.Load() < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for stream to reconnect")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// A stream closed right away is retried after a while.
+	client.messages <- nil
+	waitStreams(2, 5*time.Second)
+
+	// One that was working is reopened right away, as Sense closes them from
+	// time to time.
+	time.Sleep(1100 * time.Millisecond)
+	client.messages <- nil
+	waitStreams(3, 500*time.Millisecond)
+
+	metrics := collectMetrics(t, exporter.NewStreamCollector(stream))
+	for _, m := range metrics["sense_scrape_errors_total"] {
+		if got := m.GetCounter().GetValue(); got != 0 {
+			t.Errorf("Expected a normal close not to be counted, got sense_scrape_errors_total%v = %v", labels(m), got)
+		}
+	}
+}
+
+func TestExporterProbe(t *testing.T) {
+	client1 := &mockClient{accountID: 1, monitors: []sense.Monitor{{ID: 100}}, totalWatts: 100}
+	client2 := &mockClient{accountID: 2, monitors: []sense.Monitor{{ID: 200}}, totalWatts: 200}
+	exp := exporter.NewExporter([]exporter.Client{client1, client2}, time.Second)
+
+	rec := httptest.NewRecorder()
+	exp.ServeProbe(rec, httptest.NewRequest("GET", "/probe?monitor=200", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, `sense_monitor_watts{monitor="200"} 200`) {
+		t.Errorf("Expected monitor 200:\n%s", body)
+	}
+	if strings.Contains(body, `monitor="100"`) {
+		t.Errorf("Expected only monitor 200:\n%s", body)
+	}
+
+	for query, want := range map[string]int{
+		"":             http.StatusBadRequest,
+		"?monitor=abc": http.StatusBadRequest,
+		"?monitor=300": http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		exp.ServeProbe(rec, httptest.NewRequest("GET", "/probe"+query, nil))
+		if rec.Code != want {
+			t.Errorf("/probe%s: expected status %d, got %d", query, want, rec.Code)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	exp.ServeTargets(rec, httptest.NewRequest("GET", "/targets", nil))
+	var groups []struct {
+		Targets []string          `json:"targets"`
+		Labels  map[string]string `json:"labels"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &groups); err != nil {
+		t.Fatalf("Failed to parse targets: %v\n%s", err, rec.Body)
+	}
+	var targets []string
+	for _, g := range groups {
+		targets = append(targets, g.Targets...)
+		if g.Labels["__meta_sense_monitor_id"] != g.Targets[0] {
+			t.Errorf("Expected monitor ID label for %v, got %v", g.Targets, g.Labels)
+		}
+	}
+	if want := []string{"100", "200"}; !slices.Equal(targets, want) {
+		t.Errorf("Expected targets %v, got %v", want, targets)
+	}
+}
+
+func TestExporterMaxConcurrency(t *testing.T) {
+	for _, limit := range []int{0, 2} {
+		f := &inFlight{}
+		var clients []exporter.Client
+		for i := range 4 {
+			clients = append(clients, &mockClient{
+				accountID: i,
+				monitors:  []sense.Monitor{{ID: 100 + i}},
+				inFlight:  f,
+			})
+		}
+		exp := exporter.NewExporter(clients, time.Second)
+		exp.SetOptions(exporter.Options{MaxConcurrency: limit})
+		body := scrape(t, exp)
+		for i := range 4 {
+			if want := fmt.Sprintf(`sense_monitor_up{monitor="%d"} 1`, 100+i); !strings.Contains(body, want) {
+				t.Errorf("max-concurrency %d: expected %s:\n%s", limit, want, body)
+			}
+		}
+		want := cmp.Or(limit, 4)
+		if f.max != want {
+			t.Errorf("max-concurrency %d: expected %d monitors collected at once, got %d", limit, want, f.max)
+		}
+	}
+}
+
+func TestExporterMaxConcurrencyTimeout(t *testing.T) {
+	// Each collection takes longer than the timeout, so whichever monitor
+	// is left waiting for its turn gives up.
+	f := &inFlight{}
+	var clients []exporter.Client
+	for i := range 2 {
+		clients = append(clients, &mockClient{
+			accountID: i,
+			monitors:  []sense.Monitor{{ID: 100 + i}},
+			inFlight:  f,
+		})
+	}
+	exp := exporter.NewExporter(clients, 20*time.Millisecond)
+	exp.SetOptions(exporter.Options{MaxConcurrency: 1})
+	body := scrape(t, exp)
+	if got := strings.Count(body, `sense_monitor_up{monitor="10`); got != 2 {
+		t.Fatalf("Expected both monitors to be reported, got %d:\n%s", got, body)
+	}
+	if got := strings.Count(body, `reason="timeout",stage="devices"} 1`); got != 1 {
+		t.Errorf("Expected one monitor to time out waiting, got %d:\n%s", got, body)
+	}
+	if f.total != 1 {
+		t.Errorf("Expected 1 collection, got %d", f.total)
+	}
+}
+
+func TestExporterCoalesce(t *testing.T) {
+	f := &inFlight{}
+	client := &mockClient{
+		accountID:  1,
+		monitors:   []sense.Monitor{{ID: 100}},
+		totalWatts: 100,
+		inFlight:   f,
+	}
+	exp := exporter.NewExporter([]exporter.Client{client}, time.Second)
+
+	// Concurrent scrapes share a collection.
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if body := scrape(t, exp); !strings.Contains(body, `sense_monitor_watts{monitor="100"} 100`) {
+				t.Errorf("Expected sense_monitor_watts:\n%s", body)
+			}
+		}()
+	}
+	wg.Wait()
+	if f.total != 1 {
+		t.Errorf("Expected 1 collection for concurrent scrapes, got %d", f.total)
+	}
+
+	// Without a minimum interval, the next scrape collects again.
+	scrape(t, exp)
+	if f.total != 2 {
+		t.Errorf("Expected 2 collections, got %d", f.total)
+	}
+
+	// Within the minimum interval, it reuses the last collection.
+	exp.SetOptions(exporter.Options{MinInterval: time.Hour})
+	body := scrape(t, exp)
+	if f.total != 2 {
+		t.Errorf("Expected 2 collections within the minimum interval, got %d", f.total)
+	}
+	if !strings.Contains(body, `sense_monitor_watts{monitor="100"} 100`) {
+		t.Errorf("Expected sense_monitor_watts from the last collection:\n%s", body)
+	}
+}
+
+func TestExporterCollectPanic(t *testing.T) {
+	f := &inFlight{}
+	client := &mockClient{
+		accountID:    1,
+		monitors:     []sense.Monitor{{ID: 100}},
+		inFlight:     f,
+		devicesPanic: true,
+	}
+	exp := exporter.NewExporter([]exporter.Client{client}, time.Second)
+
+	// The exporter survives, and the next scrape tries again.
+	scrape(t, exp)
+	scrape(t, exp)
+	if f.total != 2 {
+		t.Errorf("Expected 2 collections, got %d", f.total)
+	}
+}
+
+func TestExporterMaxStaleness(t *testing.T) {
+	client := &mockClient{
+		accountID:  1,
+		monitors:   []sense.Monitor{{ID: 100}},
+		totalWatts: 100,
+	}
+	exp := exporter.NewExporter([]exporter.Client{client}, time.Second)
+	body := scrape(t, exp)
+	if !strings.Contains(body, `sense_data_age_seconds{monitor="100"}`) {
+		t.Errorf("Expected sense_data_age_seconds:\n%s", body)
+	}
+
+	// By default, nothing is reported once Sense goes away.
+	client.devicesErr = errors.New("service unavailable")
+	body = scrape(t, exp)
+	if strings.Contains(body, "sense_monitor_watts") || strings.Contains(body, "sense_data_age_seconds") {
+		t.Errorf("Expected no data:\n%s", body)
+	}
+
+	// With max-staleness, the last data is reported instead.
+	exp.SetOptions(exporter.Options{MaxStaleness: time.Hour})
+	body = scrape(t, exp)
+	for _, want := range []string{
+		`sense_monitor_up{monitor="100"} 0`,
+		`sense_monitor_watts{monitor="100"} 100`,
+		`sense_data_age_seconds{monitor="100"}`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %s:\n%s", want, body)
+		}
+	}
+
+	// But only for so long.
+	exp.SetOptions(exporter.Options{MaxStaleness: time.Nanosecond})
+	body = scrape(t, exp)
+	if strings.Contains(body, "sense_monitor_watts") {
+		t.Errorf("Expected data to be too old:\n%s", body)
+	}
+}
+
+func BenchmarkExporterScrape(b *testing.B) {
+	var clients []exporter.Client
+	for i := range 3 {
+		clients = append(clients, &mockClient{
+			accountID: i,
+			monitors:  []sense.Monitor{{ID: 100 + i}},
+			devices: []mockDevice{
+				{ID: "device1", Name: "Light", Type: "Light", Watts: 60},
+				{ID: "device2", Name: "Fridge", Type: "Refrigerator", Watts: 150},
+			},
+			totalWatts: 1000,
+			voltages:   []float32{120, 121},
+			channels:   []float32{500, 500},
+		})
+	}
+	exp := exporter.NewExporter(clients, time.Second)
+	req := httptest.NewRequest("GET", "/metrics", nil)
+
+	b.ReportAllocs()
+	for b.Loop() {
+		rec := httptest.NewRecorder()
+		exp.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			b.Fatalf("Expected status 200, got %d", rec.Code)
+		}
+	}
+}
+
+func TestExporterRefreshMonitors(t *testing.T) {
+	client := &mockClient{accountID: 1, monitors: []sense.Monitor{{ID: 100}}, totalWatts: 100}
+	exp := exporter.NewExporter([]exporter.Client{client}, time.Second)
+
+	// Nothing changed, so the client is left alone.
+	ctx := context.Background()
+	err := exp.RefreshMonitors(ctx, func(ctx context.Context, cl exporter.Client) (exporter.Client, error) {
+		return &mockClient{accountID: 1, monitors: []sense.Monitor{{ID: 100}}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := scrape(t, exp); !strings.Contains(body, `sense_monitor_watts{monitor="100"} 100`) {
+		t.Errorf("Expected the original client to remain:\n%s", body)
+	}
+
+	// A monitor appears.
+	client = &mockClient{accountID: 1, monitors: []sense.Monitor{{ID: 100}, {ID: 200}}, totalWatts: 200}
+	exp.RefreshMonitors(ctx, func(ctx context.Context, cl exporter.Client) (exporter.Client, error) {
+		return client, nil
+	})
+	body := scrape(t, exp)
+	for _, want := range []string{
+		`sense_monitor_up{monitor="200"} 1`,
+		"sense_monitors 2",
+		"sense_monitors_appeared_total 1",
+		"sense_monitors_disappeared_total 0",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %s:\n%s", want, body)
+		}
+	}
+
+	// A monitor disappears, and so do its metrics.
+	exp.RefreshMonitors(ctx, func(ctx context.Context, cl exporter.Client) (exporter.Client, error) {
+		return &mockClient{accountID: 1, monitors: []sense.Monitor{{ID: 200}}}, nil
+	})
+	body = scrape(t, exp)
+	if strings.Contains(body, `monitor="100"`) {
+		t.Errorf("Expected monitor 100 to be gone:\n%s", body)
+	}
+	for _, want := range []string{
+		"sense_monitors 1",
+		"sense_monitors_disappeared_total 1",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %s:\n%s", want, body)
+		}
+	}
+
+	// Errors are reported, and leave the client alone.
+	err = exp.RefreshMonitors(ctx, func(ctx context.Context, cl exporter.Client) (exporter.Client, error) {
+		return nil, errors.New("login failed")
+	})
+	if err == nil || !strings.Contains(err.Error(), "account 1") {
+		t.Errorf("Expected an error for account 1, got %v", err)
+	}
+	if body := scrape(t, exp); !strings.Contains(body, `sense_monitor_up{monitor="200"} 1`) {
+		t.Errorf("Expected monitor 200 to remain:\n%s", body)
+	}
+}
+
+func TestExporterDuplicateMonitors(t *testing.T) {
+	newClients := func() []exporter.Client {
+		return []exporter.Client{
+			&mockClient{accountID: 1, monitors: []sense.Monitor{{ID: 100}, {ID: 200}}, totalWatts: 100, stayConnected: true},
+			&mockClient{accountID: 2, monitors: []sense.Monitor{{ID: 100}}, totalWatts: 150, stayConnected: true},
+		}
+	}
+
+	t.Run("dedupe", func(t *testing.T) {
+		exp := exporter.NewExporter(newClients(), time.Second)
+		body := scrape(t, exp)
+		if !strings.Contains(body, `sense_monitor_watts{monitor="100"} 100`) {
+			t.Errorf("Expected monitor 100 from the first account:\n%s", body)
+		}
+		if n := strings.Count(body, `sense_monitor_watts{monitor="100"}`); n != 1 {
+			t.Errorf("Expected monitor 100 once, got %d:\n%s", n, body)
+		}
+		if !strings.Contains(body, `sense_monitor_watts{monitor="200"} 100`) {
+			t.Errorf("Expected monitor 200:\n%s", body)
+		}
+	})
+
+	t.Run("dedupe streaming", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		exp := exporter.NewExporter(newClients(), time.Second)
+		exp.Start(ctx)
+		body := waitForScrape(t, exp, `sense_monitor_watts{monitor="100"} 100`)
+		if n := strings.Count(body, `sense_monitor_watts{monitor="100"}`); n != 1 {
+			t.Errorf("Expected monitor 100 once, got %d:\n%s", n, body)
+		}
+	})
+
+	t.Run("account label", func(t *testing.T) {
+		exp := exporter.NewExporter(newClients(), time.Second)
+		exp.SetOptions(exporter.Options{DuplicateMonitors: exporter.DuplicatesAccountLabel})
+		body := scrape(t, exp)
+		for _, want := range []string{
+			`sense_monitor_watts{account="1",monitor="100"} 100`,
+			`sense_monitor_watts{account="2",monitor="100"} 150`,
+			`sense_monitor_watts{account="1",monitor="200"} 100`,
+		} {
+			if !strings.Contains(body, want) {
+				t.Errorf("Expected %s:\n%s", want, body)
+			}
+		}
+	})
+
+	t.Run("account label energy", func(t *testing.T) {
+		// Each account's stream keeps its own energy totals.
+		stateFile := filepath.Join(t.TempDir(), "state.json")
+		saved := `{"monitors":{"1/100":{"monitor":1000},"2/100":{"monitor":2000}}}`
+		if err := os.WriteFile(stateFile, []byte(saved), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		exp := exporter.NewExporter(newClients(), time.Second)
+		exp.SetOptions(exporter.Options{DuplicateMonitors: exporter.DuplicatesAccountLabel})
+		if err := exp.LoadEnergy(stateFile); err != nil {
+			t.Fatal(err)
+		}
+		exp.Start(ctx)
+		waitForScrape(t, exp, `sense_monitor_watts{account="1",monitor="100"} 100`)
+		body := waitForScrape(t, exp, `sense_monitor_watts{account="2",monitor="100"} 150`)
+		for _, want := range []string{
+			`sense_monitor_energy_joules_total{account="1",monitor="100"} 1000`,
+			`sense_monitor_energy_joules_total{account="2",monitor="100"} 2000`,
+		} {
+			if !strings.Contains(body, want) {
+				t.Errorf("Expected %s:\n%s", want, body)
+			}
+		}
+
+		if err := exp.SaveEnergy(stateFile); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(stateFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var state struct {
+			Monitors map[string]struct{ Monitor float64 }
+		}
+		if err := json.Unmarshal(b, &state); err != nil {
+			t.Fatal(err)
+		}
+		for k, want := range map[string]float64{"1/100": 1000, "2/100": 2000, "1/200": 0} {
+			if m, ok := state.Monitors[k]; !ok || m.Monitor != want {
+				t.Errorf("Expected %s to be saved with %v, got %+v", k, want, state.Monitors)
+			}
+		}
+	})
+}
+
+func TestCollectorMonitorInfo(t *testing.T) {
+	client := &mockClient{
+		accountID: 1,
+		monitors: []sense.Monitor{{
+			ID:              100,
+			SerialNumber:    "N123",
+			TimeZone:        "America/Los_Angeles",
+			SolarConfigured: true,
+		}},
+		totalWatts: 100,
+	}
+	exp := exporter.NewExporter([]exporter.Client{client}, time.Second)
+	exp.SetOptions(exporter.Options{
+		AccountLabel: true,
+		Monitors:     map[int]exporter.MonitorOptions{100: {Name: "home"}},
+	})
+	body := scrape(t, exp)
+	for _, want := range []string{
+		`sense_monitor_info{account="1",account_id="1",monitor="100",name="home",serial="N123",solar_configured="true",time_zone="America/Los_Angeles"} 1`,
+		`sense_monitor_watts{account="1",monitor="100"} 100`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %s:\n%s", want, body)
+		}
+	}
+}
+
+func TestCollectorDeviceRules(t *testing.T) {
+	client := &mockClient{
+		devices: []mockDevice{
+			{ID: "light1", Name: "Living Room Light", Type: "Light", Make: "Philips", Model: "Hue", Watts: 25},
+			{ID: "light2", Name: "Porch Light", Type: "Light", Make: "Philips", Model: "Hue", Watts: 10},
+			{ID: "motor3", Name: "Motor 3", Type: "Motor", Watts: 300},
+			{ID: "heat5", Name: "Heat 5", Type: "Heat", Watts: 1500},
+			{ID: "fridge", Name: "Fridge", Type: "Refrigerator", Make: "LG", Watts: 150},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		devices     exporter.DeviceOptions
+		want        []string
+		wantDropped float64 // -1 if not reported
+	}{
+		{
+			name:        "exclude by name",
+			devices:     exporter.DeviceOptions{Exclude: []exporter.DeviceRule{{Name: `(Motor|Heat) \d+`}}},
+			want:        []string{"fridge", "light1", "light2"},
+			wantDropped: -1,
+		},
+		{
+			name:        "name must match whole name",
+			devices:     exporter.DeviceOptions{Exclude: []exporter.DeviceRule{{Name: "Light"}}},
+			want:        []string{"fridge", "heat5", "light1", "light2", "motor3"},
+			wantDropped: -1,
+		},
+		{
+			name:        "include by type",
+			devices:     exporter.DeviceOptions{Include: []exporter.DeviceRule{{Type: "Light"}, {Type: "Refrigerator"}}},
+			want:        []string{"fridge", "light1", "light2"},
+			wantDropped: -1,
+		},
+		{
+			name: "make and model",
+			devices: exporter.DeviceOptions{
+				Include: []exporter.DeviceRule{{Make: "Philips", Model: "Hue"}},
+				Exclude: []exporter.DeviceRule{{Name: "Porch.*"}},
+			},
+			want:        []string{"light1"},
+			wantDropped: -1,
+		},
+		{
+			name:        "cap",
+			devices:     exporter.DeviceOptions{MaxPerMonitor: 2},
+			want:        []string{"fridge", "heat5"},
+			wantDropped: 3,
+		},
+		{
+			name:        "cap not reached",
+			devices:     exporter.DeviceOptions{MaxPerMonitor: 10},
+			want:        []string{"fridge", "heat5", "light1", "light2", "motor3"},
+			wantDropped: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := exporter.Options{Devices: tt.devices}
+			if err := opts.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			collector := exporter.NewCollector(context.Background(), client, 789, time.Second)
+			collector.SetOptions(opts)
+			metrics := collectMetrics(t, collector)
+
+			got := slices.Sorted(maps.Keys(extractDeviceWattsByID(t, metrics["sense_device_watts"])))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Expected devices %v, got %v", tt.want, got)
+			}
+			if tt.wantDropped < 0 {
+				verifyMetricsMissing(t, metrics, []string{"sense_devices_dropped"})
+			} else {
+				verifyMetricValue(t, metrics, "sense_devices_dropped", tt.wantDropped)
+			}
+		})
+	}
+
+	opts := exporter.Options{Devices: exporter.DeviceOptions{
+		Include:       []exporter.DeviceRule{{Name: "("}},
+		MaxPerMonitor: -1,
+	}}
+	err := opts.Validate()
+	for _, key := range []string{"devices.include[0]: name:", "devices.max-per-monitor:"} {
+		if err == nil || !strings.Contains(err.Error(), key) {
+			t.Errorf("Expected error to mention %s, got: %v", key, err)
+		}
+	}
+}
+
+func TestCollectorDeviceLabels(t *testing.T) {
+	client := &mockClient{
+		devices: []mockDevice{
+			{ID: "light1", Name: "Living Room Light", Type: "Light", Watts: 25, Active: true, Online: true},
+			{ID: "fridge", Name: "Fridge", Type: "Refrigerator", Watts: 150},
+		},
+	}
+
+	for _, slim := range []bool{false, true} {
+		opts := exporter.Options{
+			DeviceIDLabelsOnly: slim,
+			Devices: exporter.DeviceOptions{Overrides: map[string]exporter.DeviceOverride{
+				"light1": {Name: "Lamp", Labels: map[string]string{"room": "living", "circuit": "12"}},
+				"fridge": {Labels: map[string]string{"room": "kitchen"}},
+			}},
+		}
+		if err := opts.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		collector := exporter.NewCollector(context.Background(), client, 789, time.Second)
+		collector.SetOptions(opts)
+
+		// A pedantic registry checks that every series in a family has the
+		// same labels, and that they match what was described.
+		reg := prometheus.NewPedanticRegistry()
+		reg.MustRegister(collector)
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, mf := range families {
+			if !strings.HasPrefix(mf.GetName(), "sense_device_") {
+				continue
+			}
+			for _, m := range mf.GetMetric() {
+				found = true
+				got := labels(m)
+				want := map[string]string{
+					"light1": "living",
+					"fridge": "kitchen",
+				}[got["device_id"]]
+				if got["room"] != want {
+					t.Errorf("%s{device_id=%q}: expected room=%q, got %v", mf.GetName(), got["device_id"], want, got)
+				}
+				if _, ok := got["circuit"]; !ok {
+					t.Errorf("%s{device_id=%q}: expected a circuit label, got %v", mf.GetName(), got["device_id"], got)
+				}
+				if mf.GetName() == "sense_device_info" && got["device_id"] == "light1" && got["name"] != "Lamp" {
+					t.Errorf("Expected light1 to be named Lamp, got %v", got)
+				}
+			}
+		}
+		if !found {
+			t.Error("Expected device metrics")
+		}
+	}
+
+	opts := exporter.Options{Devices: exporter.DeviceOptions{Overrides: map[string]exporter.DeviceOverride{
+		"light1": {Labels: map[string]string{"bad-name": "x", "name": "x"}},
+	}}}
+	err := opts.Validate()
+	for _, key := range []string{"devices.overrides.light1.labels.bad-name:", "devices.overrides.light1.labels.name:"} {
+		if err == nil || !strings.Contains(err.Error(), key) {
+			t.Errorf("Expected error to mention %s, got: %v", key, err)
+		}
+	}
+}
+
+func TestCollectorGroups(t *testing.T) {
+	client := &mockClient{
+		monitors: []sense.Monitor{{ID: 789}},
+		devices: []mockDevice{
+			{ID: "furnace", Name: "Furnace", Type: "Heat", Watts: 500},
+			{ID: "ac", Name: "AC", Type: "AC", Watts: 1000},
+			{ID: "light1", Name: "Kitchen Light", Type: "Light", Watts: 25},
+			{ID: "fridge", Name: "Fridge", Type: "Refrigerator", Watts: 150},
+		},
+		stayConnected: true,
+		messages:      make(chan realtime.Message),
+	}
+
+	opts := exporter.Options{
+		Devices: exporter.DeviceOptions{
+			// Groups include devices that aren't exported.
+			Exclude: []exporter.DeviceRule{{ID: "furnace"}},
+			Overrides: map[string]exporter.DeviceOverride{
+				"light1": {Labels: map[string]string{"room": "kitchen"}},
+				"fridge": {Labels: map[string]string{"room": "kitchen"}},
+			},
+		},
+		Groups: map[string][]exporter.DeviceRule{
+			"HVAC":    {{ID: "furnace"}, {Type: "AC"}},
+			"kitchen": {{Labels: map[string]string{"room": "kitchen"}}},
+			"empty":   {{ID: "bogus"}},
+		},
+	}
+	if err := opts.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	collector := exporter.NewCollector(context.Background(), client, 789, time.Second)
+	collector.SetOptions(opts)
+	metrics := collectMetrics(t, collector)
+	want := map[string]float64{"HVAC": 1500, "kitchen": 175, "empty": 0}
+	got := make(map[string]float64)
+	for _, m := range metrics["sense_group_watts"] {
+		got[labels(m)["group"]] = m.GetGauge().GetValue()
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("Expected group watts %v, got %v", want, got)
+	}
+	verifyMetricsMissing(t, metrics, []string{"sense_group_energy_joules_total"})
+
+	// Group energy is the total of its members' energy.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := exporter.NewStream(client, 789, time.Second)
+	clock := newFakeClock()
+	exporter.SetStreamClock(stream, clock.Now)
+	go stream.Run(ctx)
+	update := &realtime.RealtimeUpdate{Devices: []realtime.Device{
+		{ID: "furnace", W: 500},
+		{ID: "ac", W: 1000},
+		{ID: "light1", W: 25},
+		{ID: "fridge", W: 150},
+	}}
+	updateStream(client, clock, update, 10, 100*time.Millisecond)
+	collector = exporter.NewStreamCollector(stream)
+	collector.SetOptions(opts)
+	metrics = collectMetrics(t, collector)
+	want = map[string]float64{"HVAC": 1500, "kitchen": 175, "empty": 0}
+	got = make(map[string]float64)
+	for _, m := range metrics["sense_group_energy_joules_total"] {
+		got[labels(m)["group"]] = m.GetCounter().GetValue()
+	}
+	if !maps.EqualFunc(got, want, func(a, b float64) bool { return math.Abs(a-b) < 1e-6 }) {
+		t.Errorf("Expected group energy %v, got %v", want, got)
+	}
+
+	opts = exporter.Options{Groups: map[string][]exporter.DeviceRule{"HVAC": {{}}}}
+	if err := opts.Validate(); err == nil || !strings.Contains(err.Error(), "groups.HVAC[0]:") {
+		t.Errorf("Expected error to mention groups.HVAC[0], got: %v", err)
+	}
+}
+
+func TestCollectorUnattributed(t *testing.T) {
+	client := &mockClient{
+		monitors: []sense.Monitor{{ID: 789}},
+		devices: []mockDevice{
+			{ID: "light1", Name: "Living Room Light", Watts: 25},
+			{ID: "motor3", Name: "Motor 3", Watts: 300},
+		},
+		totalWatts:    1000,
+		stayConnected: true,
+		messages:      make(chan realtime.Message),
+	}
+	opts := exporter.Options{
+		Devices: exporter.DeviceOptions{Exclude: []exporter.DeviceRule{{ID: "motor3"}}},
+	}
+
+	collector := exporter.NewCollector(context.Background(), client, 789, time.Second)
+	collector.SetOptions(opts)
+	metrics := collectMetrics(t, collector)
+	verifyMetricValue(t, metrics, "sense_monitor_unattributed_watts", 975)
+
+	opts.Metrics = map[string]bool{exporter.FamilyDevices: false}
+	collector.SetOptions(opts)
+	metrics = collectMetrics(t, collector)
+	verifyMetricValue(t, metrics, "sense_monitor_unattributed_watts", 1000)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := exporter.NewStream(client, 789, time.Second)
+	clock := newFakeClock()
+	exporter.SetStreamClock(stream, clock.Now)
+	go stream.Run(ctx)
+	update := &realtime.RealtimeUpdate{W: 1000, Devices: []realtime.Device{{ID: "light1", W: 25}, {ID: "motor3", W: 300}}}
+	updateStream(client, clock, update, 10, 100*time.Millisecond)
+	collector = exporter.NewStreamCollector(stream)
+	opts.Metrics = nil
+	collector.SetOptions(opts)
+	metrics = collectMetrics(t, collector)
+	// Unidentified energy excludes every device, exported or not, so 675W
+	// of the 1000W over the 1s.
+	if got := metrics["sense_monitor_unidentified_energy_joules_total"][0].GetCounter().GetValue(); math.Abs(got-675) > 1e-6 {
+		t.Errorf("Expected unidentified energy 675, got %.1f", got)
+	}
+}
+
+func TestCollectorIncludeMerged(t *testing.T) {
+	client := &mockClient{
+		monitors: []sense.Monitor{{ID: 789}},
+		devices: []mockDevice{
+			{ID: "fridge", Name: "Fridge", Watts: 150},
+			{ID: "motor3", Name: "Motor 3", MergedInto: "fridge"},
+			{ID: "motor4", Name: "Motor 4", MergedInto: "fridge"},
+		},
+	}
+
+	for _, includeMerged := range []bool{false, true} {
+		collector := exporter.NewCollector(context.Background(), client, 789, time.Second)
+		collector.SetOptions(exporter.Options{Devices: exporter.DeviceOptions{IncludeMerged: includeMerged}})
+		metrics := collectMetrics(t, collector)
+
+		var info []string
+		for _, m := range metrics["sense_device_info"] {
+			info = append(info, labels(m)["device_id"])
+		}
+		slices.Sort(info)
+		want := []string{"fridge"}
+		if includeMerged {
+			want = []string{"fridge", "motor3", "motor4"}
+		}
+		if !slices.Equal(info, want) {
+			t.Errorf("includeMerged=%v: expected sense_device_info for %v, got %v", includeMerged, want, info)
+		}
+
+		var merged []string
+		for _, m := range metrics["sense_device_merged_into"] {
+			l := labels(m)
+			merged = append(merged, l["device_id"]+"->"+l["parent_id"])
+		}
+		slices.Sort(merged)
+		if want := []string{"motor3->fridge", "motor4->fridge"}; !slices.Equal(merged, want) {
+			t.Errorf("includeMerged=%v: expected sense_device_merged_into %v, got %v", includeMerged, want, merged)
+		}
+	}
+}
+
+func TestCollectorDeviceLifecycle(t *testing.T) {
+	client := &mockClient{
+		devices: []mockDevice{
+			{ID: "light1", Name: "Living Room Light", Watts: 25},
+			{ID: "motor3", Name: "Motor 3", Watts: 300},
+		},
+	}
+	collector := exporter.NewCollector(context.Background(), client, 789, time.Second)
+
+	firstSeen := func(metrics map[string][]*dto.Metric) map[string]float64 {
+		got := make(map[string]float64)
+		for _, m := range metrics["sense_device_first_seen_timestamp_seconds"] {
+			got[labels(m)["device_id"]] = m.GetGauge().GetValue()
+		}
+		return got
+	}
+
+	// Devices already there aren't counted as discovered.
+	metrics := collectMetrics(t, collector)
+	if v := metrics["sense_devices_discovered_total"][0].GetCounter().GetValue(); v != 0 {
+		t.Errorf("Expected sense_devices_discovered_total=0, got %f", v)
+	}
+	before := firstSeen(metrics)
+	if len(before) != 2 {
+		t.Fatalf("Expected first seen times for 2 devices, got %v", before)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	client.devices = []mockDevice{
+		{ID: "light1", Name: "Lamp", Watts: 25},
+		{ID: "kettle", Name: "Kettle", Watts: 1500},
+	}
+	metrics = collectMetrics(t, collector)
+	for _, name := range []string{"sense_devices_discovered_total", "sense_devices_renamed_total", "sense_devices_removed_total"} {
+		if v := metrics[name][0].GetCounter().GetValue(); v != 1 {
+			t.Errorf("Expected %s=1, got %f", name, v)
+		}
+	}
+	after := firstSeen(metrics)
+	if after["light1"] != before["light1"] {
+		t.Errorf("Expected light1 first seen time to stay %f, got %f", before["light1"], after["light1"])
+	}
+	if after["kettle"] <= before["light1"] {
+		t.Errorf("Expected kettle to be first seen after light1, got %f <= %f", after["kettle"], before["light1"])
+	}
+	if _, ok := after["motor3"]; ok {
+		t.Error("Expected no first seen time for removed device motor3")
+	}
+}
+
+func TestExporterDeviceHistory(t *testing.T) {
+	client := &mockClient{
+		accountID: 1,
+		monitors:  []sense.Monitor{{ID: 789}},
+		devices:   []mockDevice{{ID: "light1", Name: "Living Room Light"}},
+	}
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	firstSeen := func(body string) string {
+		for line := range strings.Lines(body) {
+			if strings.HasPrefix(line, `sense_device_first_seen_timestamp_seconds{device_id="light1"`) {
+				return line
+			}
+		}
+		t.Fatalf("Expected a first seen time for light1:\n%s", body)
+		return ""
+	}
+
+	exp := exporter.NewExporter([]exporter.Client{client}, time.Second)
+	before := firstSeen(scrape(t, exp))
+	client.devices = append(client.devices, mockDevice{ID: "kettle", Name: "Kettle"})
+	scrape(t, exp)
+	if err := exp.SaveEnergy(stateFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// After a restart, devices keep their first seen times, the counters
+	// continue, and devices that appeared in the meantime are discovered.
+	client.devices = append(client.devices, mockDevice{ID: "motor3", Name: "Motor 3"})
+	time.Sleep(10 * time.Millisecond)
+	exp = exporter.NewExporter([]exporter.Client{client}, time.Second)
+	if err := exp.LoadEnergy(stateFile); err != nil {
+		t.Fatal(err)
+	}
+	body := scrape(t, exp)
+	if after := firstSeen(body); after != before {
+		t.Errorf("Expected light1 to keep its first seen time:\n%s\n%s", before, after)
+	}
+	if want := `sense_devices_discovered_total{monitor="789"} 2`; !strings.Contains(body, want) {
+		t.Errorf("Expected %s:\n%s", want, body)
+	}
+}
+
+func TestStreamActivity(t *testing.T) {
+	client := &mockClient{
+		monitors: []sense.Monitor{{ID: 789}},
+		devices: []mockDevice{
+			{ID: "kettle", Name: "Kettle"},
+			{ID: "light1", Name: "Living Room Light", Watts: 25, Active: true},
+		},
+		stayConnected: true,
+		messages:      make(chan realtime.Message),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := exporter.NewStream(client, 789, time.Second)
+	clock := newFakeClock()
+	exporter.SetStreamClock(stream, clock.Now)
+	go stream.Run(ctx)
+	collector := exporter.NewStreamCollector(stream)
+
+	// Each message is sent once the previous one has been handled, so
+	// repeating the last one waits for it.
+	var last realtime.Message
+	send := func(msg realtime.Message) {
+		client.messages <- msg
+		last = msg
+	}
+	counters := func(name string) map[string]float64 {
+		send(last)
+		got := make(map[string]float64)
+		for _, m := range collectMetrics(t, collector)[name] {
+			got[labels(m)["device_id"]] = m.GetCounter().GetValue()
+		}
+		return got
+	}
+
+	// The light was already on when we connected, so that doesn't count
+	// as turning on.
+	light := realtime.Device{ID: "light1", W: 25}
+	send(&realtime.RealtimeUpdate{Devices: []realtime.Device{{ID: "kettle", W: 1500}, light}})
+	clock.Advance(100 * time.Millisecond)
+	send(&realtime.RealtimeUpdate{Devices: []realtime.Device{light}})
+	// The light is on while it's either active or drawing power.
+	send(&realtime.DeviceStates{States: []realtime.DeviceState{{DeviceID: "light1", Mode: "inactive"}}})
+	send(&realtime.RealtimeUpdate{})
+	send(&realtime.DeviceStates{States: []realtime.DeviceState{{DeviceID: "light1", Mode: "active"}}})
+
+	if got, want := counters("sense_device_activations_total"), map[string]float64{"kettle": 1, "light1": 1}; !maps.Equal(got, want) {
+		t.Errorf("Expected activations %v, got %v", want, got)
+	}
+	if got := counters("sense_device_active_seconds_total")["kettle"]; math.Abs(got-0.1) > 1e-9 {
+		t.Errorf("Expected kettle to be active for 0.1s, got %f", got)
+	}
+
+	// Once the light turns off, we lose the connection.  The light was on
+	// again by the time we reconnected, but we don't know when it turned on,
+	// so that doesn't count either.
+	send(&realtime.DeviceStates{States: []realtime.DeviceState{{DeviceID: "light1", Mode: "inactive"}}})
+	send(&realtime.RealtimeUpdate{})
+	send(nil)
+	send(&realtime.DeviceStates{States: []realtime.DeviceState{{DeviceID: "light1", Mode: "active"}}})
+	if got := counters("sense_device_activations_total")["light1"]; got != 1 {
+		t.Errorf("Expected light1 to have turned on once, got %v", got)
+	}
+}
+
+func TestStreamEnergyNegativePower(t *testing.T) {
+	client := &mockClient{
+		monitors: []sense.Monitor{{ID: 789}},
+		devices: []mockDevice{
+			{ID: "inverter", Name: "Inverter", Watts: -50},
+		},
+		totalWatts:    -50,
+		stayConnected: true,
+		messages:      make(chan realtime.Message),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := exporter.NewStream(client, 789, time.Second)
+	clock := newFakeClock()
+	exporter.SetStreamClock(stream, clock.Now)
+	go stream.Run(ctx)
+	update := &realtime.RealtimeUpdate{W: -50, Devices: []realtime.Device{{ID: "inverter", W: -50}}}
+	updateStream(client, clock, update, 10, 100*time.Millisecond)
+
+	// Counters must never go down.
+	metrics := collectMetrics(t, exporter.NewStreamCollector(stream))
+	for _, name := range []string{"sense_device_energy_joules_total", "sense_monitor_energy_joules_total"} {
+		if len(metrics[name]) == 0 {
+			t.Errorf("Expected %s", name)
+		}
+		for _, m := range metrics[name] {
+			if v := m.GetCounter().GetValue(); v != 0 {
+				t.Errorf("Expected %s to stay 0, got %f", name, v)
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package exporter
+
+import (
+	"log"
+	"maps"
+	"time"
+
+	"github.com/dnesting/sense"
+)
+
+// deviceHistory tracks the devices Sense reports for a monitor from one
+// device list to the next, so that we can tell when devices are discovered,
+// renamed or removed.
+type deviceHistory struct {
+	known      map[string]sense.Device // nil until the first device list
+	firstSeen  map[string]time.Time
+	discovered int
+	renamed    int
+	removed    int
+}
+
+// update compares devices, fetched from the monitor at t, with the previous
+// device list, logging any changes.  Devices in the first list we see are
+// not counted as discovered, since they were probably there all along.  It
+// returns when we first saw each device.
+func (h *deviceHistory) update(monitor int, devices map[string]sense.Device, t time.Time) map[string]time.Time {
+	if h.firstSeen == nil {
+		h.firstSeen = make(map[string]time.Time)
+	}
+	for id, d := range devices {
+		prev, ok := h.known[id]
+		switch {
+		case !ok:
+			h.firstSeen[id] = t
+			if h.known != nil {
+				log.Printf("monitor %d: discovered device %s (%q)", monitor, id, d.Name)
+				h.discovered++
+			}
+		case prev.Name != d.Name:
+			log.Printf("monitor %d: device %s was renamed from %q to %q", monitor, id, prev.Name, d.Name)
+			h.renamed++
+		}
+	}
+	for id, d := range h.known {
+		if _, ok := devices[id]; !ok {
+			log.Printf("monitor %d: device %s (%q) was removed", monitor, id, d.Name)
+			h.removed++
+			delete(h.firstSeen, id)
+		}
+	}
+	h.known = maps.Clone(devices)
+	if h.known == nil {
+		h.known = make(map[string]sense.Device)
+	}
+	return maps.Clone(h.firstSeen)
+}
+
+// savedHistory is the form in which a deviceHistory is persisted.
+type savedHistory struct {
+	Names      map[string]string    `json:"names"` // by device ID
+	FirstSeen  map[string]time.Time `json:"first_seen"`
+	Discovered int                  `json:"discovered,omitempty"`
+	Renamed    int                  `json:"renamed,omitempty"`
+	Removed    int                  `json:"removed,omitempty"`
+}
+
+// save returns h in a form that can be persisted, or nil if there's nothing
+// worth keeping yet.
+func (h *deviceHistory) save() *savedHistory {
+	if h.known == nil {
+		return nil
+	}
+	sh := &savedHistory{
+		Names:      make(map[string]string),
+		FirstSeen:  maps.Clone(h.firstSeen),
+		Discovered: h.discovered,
+		Renamed:    h.renamed,
+		Removed:    h.removed,
+	}
+	for id, d := range h.known {
+		sh.Names[id] = d.Name
+	}
+	return sh
+}
+
+// restore replaces h with what was saved, so that the next device list is
+// compared with the last one we saw before restarting.
+func (h *deviceHistory) restore(sh *savedHistory) {
+	*h = deviceHistory{
+		known:      make(map[string]sense.Device),
+		firstSeen:  maps.Clone(sh.FirstSeen),
+		discovered: sh.Discovered,
+		renamed:    sh.Renamed,
+		removed:    sh.Removed,
+	}
+	for id, name := range sh.Names {
+		h.known[id] = sense.Device{ID: id, Name: name}
+	}
+}
@@ -0,0 +1,339 @@
+package exporter
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dnesting/sense"
+)
+
+// Metric families that can be enabled or disabled with Options.Metrics.
+const (
+	FamilyMonitor      = "monitor"       // sense_monitor_watts, _volts, _hz, _unattributed_*, _unidentified_*
+	FamilyChannels     = "channels"      // sense_monitor_channel_*
+	FamilySolar        = "solar"         // sense_monitor_solar_*, sense_monitor_grid_*
+	FamilyDevices      = "devices"       // sense_device_watts
+	FamilyDeviceStates = "device-states" // sense_device_active, _online, _activations_total, _active_seconds_total
+	FamilyDeviceInfo   = "device-info"   // sense_device_info, sense_device_merged_into
+	FamilyMonitorInfo  = "monitor-info"  // sense_monitor_info
+	FamilyEnergy       = "energy"        // *_energy_joules_total
+	FamilyGroups       = "groups"        // sense_group_*
+)
+
+var metricFamilies = []string{
+	FamilyMonitor,
+	FamilyChannels,
+	FamilySolar,
+	FamilyDevices,
+	FamilyDeviceStates,
+	FamilyDeviceInfo,
+	FamilyMonitorInfo,
+	FamilyEnergy,
+	FamilyGroups,
+}
+
+// Options controls how the Exporter presents its metrics.  Options can be
+// read from YAML, and must be validated with Validate before use.
+type Options struct {
+	// DeviceIDLabelsOnly labels per-device samples with only device_id, so
+	// that renaming a device doesn't break the continuity of its series.
+	// The remaining descriptive labels can be found on sense_device_info.
+	DeviceIDLabelsOnly bool `yaml:"device-id-labels-only"`
+
+	// AccountLabel labels every per-monitor series with the ID of the
+	// account we collected it through.
+	AccountLabel bool `yaml:"account-label"`
+
+	// Monitors holds settings for individual monitors, by monitor ID.
+	Monitors map[int]MonitorOptions `yaml:"monitors"`
+
+	// Devices controls which devices are exported and how they're labeled.
+	Devices DeviceOptions `yaml:"devices"`
+
+	// Groups defines virtual devices, by name, made up of the devices
+	// matching any of the group's rules.  Groups report the total power
+	// and energy of their members, whether or not the members themselves
+	// are exported.
+	Groups map[string][]DeviceRule `yaml:"groups"`
+
+	// Metrics enables or disables metric families by name.  Families not
+	// mentioned here are enabled.
+	Metrics map[string]bool `yaml:"metrics"`
+
+	// MaxConcurrency limits how many monitors we collect from at once, across
+	// all requests, when not streaming.  Zero means no limit.
+	MaxConcurrency int `yaml:"max-concurrency"`
+
+	// MinInterval, when not streaming, is the minimum time between
+	// collections from each monitor.  Requests within this time of the last
+	// collection get its results again.
+	MinInterval time.Duration `yaml:"min-interval"`
+
+	// MaxStaleness, if set, keeps reporting the last data received from a
+	// monitor for up to this long after we stop being able to get anything
+	// newer, instead of reporting nothing.  sense_data_age_seconds tells
+	// how old the data is.
+	MaxStaleness time.Duration `yaml:"max-staleness"`
+
+	// DuplicateMonitors says what to do about a monitor accessible to more
+	// than one account.  See DuplicatesDedupe and DuplicatesAccountLabel.
+	DuplicateMonitors string `yaml:"duplicate-monitors"`
+}
+
+// Values for Options.DuplicateMonitors.
+const (
+	// DuplicatesDedupe collects from a monitor using only the first
+	// account with access to it.  This is the default.
+	DuplicatesDedupe = "dedupe"
+	// DuplicatesAccountLabel collects from a monitor using every account
+	// with access to it, and implies AccountLabel to tell them apart.
+	DuplicatesAccountLabel = "account-label"
+)
+
+// MonitorOptions holds settings for a single monitor.
+type MonitorOptions struct {
+	// Timeout overrides the Exporter's timeout for this monitor.
+	Timeout time.Duration `yaml:"timeout"`
+	// Name is a friendly name for the monitor, e.g. "home", for
+	// sense_monitor_info.
+	Name string `yaml:"name"`
+}
+
+// DeviceOptions controls which devices are exported and how they're labeled.
+type DeviceOptions struct {
+	// Include, if not empty, exports only devices matching one of these rules.
+	Include []DeviceRule `yaml:"include"`
+	// Exclude omits devices matching any of these rules.
+	Exclude []DeviceRule `yaml:"exclude"`
+	// Overrides replaces the labels Sense provides for devices, by device ID.
+	Overrides map[string]DeviceOverride `yaml:"overrides"`
+	// IncludeMerged asks Sense for devices that have been merged into
+	// others, as well as the devices they were merged into.  When
+	// streaming, a change takes effect the next time we fetch the device
+	// list.
+	IncludeMerged bool `yaml:"include-merged"`
+	// MaxPerMonitor, if set, limits how many devices we export from each
+	// monitor.  Devices in Sense's device list are preferred, and otherwise
+	// devices are chosen by ID, so that the same ones are chosen each time.
+	MaxPerMonitor int `yaml:"max-per-monitor"`
+}
+
+// DeviceRule matches devices.  A device matches if it matches every field
+// given.  Rules see devices as they are after any overrides.
+type DeviceRule struct {
+	ID string `yaml:"id"`
+	// Name is a regular expression that must match the whole name.
+	Name  string `yaml:"name"`
+	Type  string `yaml:"type"`
+	Make  string `yaml:"make"`
+	Model string `yaml:"model"`
+	// Labels must all be given to the device with DeviceOverride.Labels.
+	Labels map[string]string `yaml:"labels"`
+
+	name *regexp.Regexp // compiled by validate
+}
+
+// DeviceOverride replaces the labels Sense provides for a device.  Empty
+// fields are left alone.
+type DeviceOverride struct {
+	Name  string `yaml:"name"`
+	Type  string `yaml:"type"`
+	Make  string `yaml:"make"`
+	Model string `yaml:"model"`
+
+	// Labels adds labels of our own to every per-device series for the
+	// device, e.g. room: kitchen.  Devices that don't set a label that
+	// another device does get it with an empty value.
+	Labels map[string]string `yaml:"labels"`
+}
+
+// labelNameRE matches valid Prometheus label names.
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Validate checks the options for errors.  Errors identify the offending key
+// relative to the options themselves, e.g. "devices.exclude[2].id".
+func (o *Options) Validate() error {
+	var errs []error
+	fail := func(key string, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+
+	if o.MaxConcurrency < 0 {
+		fail("max-concurrency", "must not be negative")
+	}
+	if o.MinInterval < 0 {
+		fail("min-interval", "must not be negative")
+	}
+	if o.MaxStaleness < 0 {
+		fail("max-staleness", "must not be negative")
+	}
+	switch o.DuplicateMonitors {
+	case "", DuplicatesDedupe, DuplicatesAccountLabel:
+	default:
+		fail("duplicate-monitors", "must be %q or %q", DuplicatesDedupe, DuplicatesAccountLabel)
+	}
+	for _, id := range slices.Sorted(maps.Keys(o.Monitors)) {
+		if o.Monitors[id].Timeout < 0 {
+			fail("monitors."+strconv.Itoa(id)+".timeout", "must not be negative")
+		}
+	}
+	for i := range o.Devices.Include {
+		if err := o.Devices.Include[i].validate(); err != nil {
+			fail(fmt.Sprintf("devices.include[%d]", i), "%v", err)
+		}
+	}
+	for i := range o.Devices.Exclude {
+		if err := o.Devices.Exclude[i].validate(); err != nil {
+			fail(fmt.Sprintf("devices.exclude[%d]", i), "%v", err)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(o.Groups)) {
+		for i := range o.Groups[name] {
+			if err := o.Groups[name][i].validate(); err != nil {
+				fail(fmt.Sprintf("groups.%s[%d]", name, i), "%v", err)
+			}
+		}
+	}
+	for _, id := range slices.Sorted(maps.Keys(o.Devices.Overrides)) {
+		for _, name := range slices.Sorted(maps.Keys(o.Devices.Overrides[id].Labels)) {
+			key := "devices.overrides." + id + ".labels." + name
+			switch {
+			case !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__"):
+				fail(key, "invalid label name")
+			case slices.Contains(deviceInfoLabels, name) || name == "monitor" || name == "account":
+				fail(key, "label is already used by the exporter")
+			}
+		}
+	}
+	if o.Devices.MaxPerMonitor < 0 {
+		fail("devices.max-per-monitor", "must not be negative")
+	}
+	for _, name := range slices.Sorted(maps.Keys(o.Metrics)) {
+		if !slices.Contains(metricFamilies, name) {
+			fail("metrics."+name, "unknown metric family (expected one of %v)", metricFamilies)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *DeviceRule) validate() error {
+	if r.ID == "" && r.Name == "" && r.Type == "" && r.Make == "" && r.Model == "" && len(r.Labels) == 0 {
+		return errors.New("rule must specify id, name, type, make, model or labels")
+	}
+	if r.Name != "" {
+		re, err := regexp.Compile("^(?:" + r.Name + ")$")
+		if err != nil {
+			return fmt.Errorf("name: %w", err)
+		}
+		r.name = re
+	}
+	return nil
+}
+
+// matches reports whether the rule matches d, which has been given labels
+// with DeviceOverride.Labels.
+func (r *DeviceRule) matches(d sense.Device, labels map[string]string) bool {
+	if r.Name != "" {
+		re := r.name
+		if re == nil {
+			// Not validated, so we have to do this every time.
+			var err error
+			if re, err = regexp.Compile("^(?:" + r.Name + ")$"); err != nil {
+				return false
+			}
+		}
+		if !re.MatchString(d.Name) {
+			return false
+		}
+	}
+	for k, v := range r.Labels {
+		if got, ok := labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return (r.ID == "" || r.ID == d.ID) &&
+		(r.Type == "" || r.Type == d.Type) &&
+		(r.Make == "" || r.Make == d.Make) &&
+		(r.Model == "" || r.Model == d.Model)
+}
+
+// accountLabel reports whether per-monitor series should be labeled with the
+// account ID.
+func (o *Options) accountLabel() bool {
+	return o.AccountLabel || o.DuplicateMonitors == DuplicatesAccountLabel
+}
+
+// enabled reports whether the named metric family should be exported.
+func (o *Options) enabled(family string) bool {
+	enabled, ok := o.Metrics[family]
+	return !ok || enabled
+}
+
+// timeout returns the timeout to use for the given monitor.
+func (o *Options) timeout(monitor int, def time.Duration) time.Duration {
+	if t := o.Monitors[monitor].Timeout; t > 0 {
+		return t
+	}
+	return def
+}
+
+// serveStale reports whether data received at t may still be reported after
+// we've failed to get anything newer.
+func (o *Options) serveStale(t time.Time) bool {
+	return o.MaxStaleness > 0 && time.Since(t) <= o.MaxStaleness
+}
+
+// includeDevice reports whether metrics for d should be exported.
+func (o *Options) includeDevice(d sense.Device) bool {
+	if len(o.Devices.Include) > 0 && !o.matchesAny(o.Devices.Include, d) {
+		return false
+	}
+	return !o.matchesAny(o.Devices.Exclude, d)
+}
+
+// inGroup reports whether d is a member of the named group.
+func (o *Options) inGroup(group string, d sense.Device) bool {
+	return o.matchesAny(o.Groups[group], d)
+}
+
+// matchesAny reports whether d matches any of rules.
+func (o *Options) matchesAny(rules []DeviceRule, d sense.Device) bool {
+	labels := o.Devices.Overrides[d.ID].Labels
+	return slices.ContainsFunc(rules, func(r DeviceRule) bool { return r.matches(d, labels) })
+}
+
+// deviceLabelNames returns the names of the labels added to per-device series
+// with DeviceOverride.Labels, in sorted order.
+func (o *Options) deviceLabelNames() []string {
+	var names []string
+	for _, ov := range o.Devices.Overrides {
+		for name := range ov.Labels {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// device returns what we know about the device with the given ID, with any
+// overrides applied.
+func (o *Options) device(devices map[string]sense.Device, id string) sense.Device {
+	d := devices[id]
+	d.ID = id
+	if ov, ok := o.Devices.Overrides[id]; ok {
+		d.Name = cmp.Or(ov.Name, d.Name)
+		d.Type = cmp.Or(ov.Type, d.Type)
+		d.Make = cmp.Or(ov.Make, d.Make)
+		d.Model = cmp.Or(ov.Model, d.Model)
+	}
+	return d
+}
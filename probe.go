@@ -0,0 +1,66 @@
+package exporter
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// ServeProbe collects from the single monitor named by the "monitor" query
+// parameter, so that each monitor can be scraped as a separate target in the
+// manner of the blackbox exporter.
+func (e *Exporter) ServeProbe(w http.ResponseWriter, r *http.Request) {
+	param := r.URL.Query().Get("monitor")
+	if param == "" {
+		http.Error(w, "monitor parameter is required", http.StatusBadRequest)
+		return
+	}
+	monitor, err := strconv.Atoi(param)
+	if err != nil {
+		http.Error(w, "invalid monitor "+strconv.Quote(param), http.StatusBadRequest)
+		return
+	}
+	e.mu.Lock()
+	h, ok := e.probes[monitor]
+	e.mu.Unlock()
+	if !ok {
+		http.Error(w, "unknown monitor "+param, http.StatusNotFound)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+// targetGroup is an entry in a Prometheus HTTP service discovery response.
+type targetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// ServeTargets lists every monitor we know about in the format expected by
+// Prometheus's HTTP service discovery.  Each target is a monitor ID, to be
+// passed to ServeProbe as the monitor parameter.
+func (e *Exporter) ServeTargets(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	clients := e.clients
+	e.mu.Unlock()
+
+	groups := []targetGroup{}
+	seen := make(map[int]bool)
+	for _, cl := range clients {
+		for _, m := range cl.GetMonitors() {
+			if seen[m.ID] {
+				continue
+			}
+			seen[m.ID] = true
+			groups = append(groups, targetGroup{
+				Targets: []string{strconv.Itoa(m.ID)},
+				Labels: map[string]string{
+					"__meta_sense_account_id": strconv.Itoa(cl.GetAccountID()),
+					"__meta_sense_monitor_id": strconv.Itoa(m.ID),
+				},
+			})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
+}
@@ -0,0 +1,384 @@
+package exporter
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dnesting/sense"
+	"github.com/dnesting/sense/realtime"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// deviceMap indexes devices by ID.  We use these in labels later.
+func deviceMap(devices []sense.Device) map[string]sense.Device {
+	devInfo := make(map[string]sense.Device)
+	for _, d := range devices {
+		devInfo[d.ID] = d
+	}
+	return devInfo
+}
+
+// findMonitor returns what cl knows about the given monitor.
+func findMonitor(cl Client, monitor int) sense.Monitor {
+	for _, m := range cl.GetMonitors() {
+		if m.ID == monitor {
+			return m
+		}
+	}
+	return sense.Monitor{ID: monitor}
+}
+
+// solarConfigured reports whether the monitor has solar configured, in which
+// case its realtime updates carry solar data.
+func solarConfigured(cl Client, monitor int) bool {
+	return findMonitor(cl, monitor).SolarConfigured
+}
+
+// snapshot holds the most recent data received from a monitor.
+type snapshot struct {
+	devices   map[string]sense.Device
+	firstSeen map[string]time.Time
+	solar     bool
+	realtime  *realtime.RealtimeUpdate
+	states    *realtime.DeviceStates
+	energy    *energyTotals
+}
+
+// collect emits metrics for whatever data is present in the snapshot.
+func (s *snapshot) collect(ch chan<- prometheus.Metric, opts *Options) {
+	exported, dropped := s.exportedDevices(opts)
+	if opts.Devices.MaxPerMonitor > 0 {
+		ch <- prometheus.MustNewConstMetric(
+			devicesDroppedDesc,
+			prometheus.GaugeValue,
+			float64(dropped),
+		)
+	}
+	// device looks up a device and reports whether it should be exported.
+	device := func(id string) (sense.Device, bool) {
+		return opts.device(s.devices, id), exported[id]
+	}
+
+	if opts.enabled(FamilyDeviceInfo) {
+		for id := range s.devices {
+			d, ok := device(id)
+			if !ok {
+				continue
+			}
+			ch <- deviceInfoDesc.metric(opts, d, prometheus.GaugeValue, 1,
+				d.Icon, formatTags(d.Tags), deviceSource(d))
+			if t, ok := s.firstSeen[id]; ok {
+				ch <- firstSeenDesc.metric(opts, d, prometheus.GaugeValue, float64(t.UnixNano())/1e9)
+			}
+			for _, child := range mergedDevices(d) {
+				ch <- prometheus.MustNewConstMetric(
+					mergedIntoDesc,
+					prometheus.GaugeValue,
+					1,
+					child,
+					id,
+				)
+			}
+		}
+	}
+
+	if msg := s.realtime; msg != nil {
+		if opts.enabled(FamilyDevices) {
+			for _, rd := range msg.Devices {
+				if d, ok := device(rd.ID); ok {
+					ch <- deviceWattsDesc.metric(opts, d, prometheus.GaugeValue, float64(rd.W))
+				}
+			}
+		}
+		if opts.enabled(FamilyMonitor) {
+			for channel, v := range msg.Voltage {
+				ch <- prometheus.MustNewConstMetric(
+					voltsDesc,
+					prometheus.GaugeValue,
+					float64(v),
+					strconv.Itoa(channel),
+				)
+			}
+			ch <- prometheus.MustNewConstMetric(
+				wattsDesc,
+				prometheus.GaugeValue,
+				float64(msg.W),
+			)
+			ch <- prometheus.MustNewConstMetric(
+				hzDesc,
+				prometheus.GaugeValue,
+				float64(msg.Hz),
+			)
+			// Whatever isn't in sense_device_watts, so that the two
+			// add up to sense_monitor_watts.
+			unattributed := float64(msg.W)
+			for _, rd := range msg.Devices {
+				if exported[rd.ID] && opts.enabled(FamilyDevices) {
+					unattributed -= float64(rd.W)
+				}
+			}
+			ch <- prometheus.MustNewConstMetric(
+				unattributedWattsDesc,
+				prometheus.GaugeValue,
+				unattributed,
+			)
+		}
+		if opts.enabled(FamilyChannels) {
+			for channel, w := range msg.Channels {
+				ch <- prometheus.MustNewConstMetric(
+					channelWattsDesc,
+					prometheus.GaugeValue,
+					float64(w),
+					strconv.Itoa(channel),
+				)
+			}
+			if r, ok := imbalance(msg.Channels); ok {
+				ch <- prometheus.MustNewConstMetric(
+					imbalanceDesc,
+					prometheus.GaugeValue,
+					r,
+				)
+			}
+		}
+		if s.solar && opts.enabled(FamilySolar) {
+			ch <- prometheus.MustNewConstMetric(
+				solarWattsDesc,
+				prometheus.GaugeValue,
+				float64(msg.SolarW),
+			)
+			ch <- prometheus.MustNewConstMetric(
+				gridWattsDesc,
+				prometheus.GaugeValue,
+				float64(msg.GridW),
+			)
+			ch <- prometheus.MustNewConstMetric(
+				gridImportWattsDesc,
+				prometheus.GaugeValue,
+				max(float64(msg.GridW), 0),
+			)
+			ch <- prometheus.MustNewConstMetric(
+				gridExportWattsDesc,
+				prometheus.GaugeValue,
+				max(-float64(msg.GridW), 0),
+			)
+		}
+	}
+
+	if msg := s.states; msg != nil && opts.enabled(FamilyDeviceStates) {
+		for _, ds := range msg.States {
+			d, ok := device(ds.DeviceID)
+			if !ok {
+				continue
+			}
+			var active, online float64
+			if ds.Mode == "active" {
+				active = 1.0
+			}
+			if ds.State == "online" {
+				online = 1.0
+			}
+			ch <- activeDesc.metric(opts, d, prometheus.GaugeValue, active)
+			ch <- onlineDesc.metric(opts, d, prometheus.GaugeValue, online)
+		}
+	}
+
+	if t := s.energy; t != nil && opts.enabled(FamilyDeviceStates) {
+		// Like energy, these are reported for every device we've seen.
+		for id, secs := range t.ActiveSeconds {
+			if d, ok := device(id); ok {
+				ch <- activationsDesc.metric(opts, d, prometheus.CounterValue, float64(t.Activations[id]))
+				ch <- activeSecondsDesc.metric(opts, d, prometheus.CounterValue, secs)
+			}
+		}
+	}
+
+	if len(opts.Groups) > 0 && opts.enabled(FamilyGroups) {
+		s.collectGroups(ch, opts)
+	}
+
+	if t := s.energy; t != nil && opts.enabled(FamilyEnergy) {
+		// Devices only appear in RealtimeUpdate while they're drawing
+		// power, so report every device we've ever seen to keep the
+		// counters continuous.
+		if opts.enabled(FamilyDevices) {
+			for id, j := range t.Devices {
+				if d, ok := device(id); ok {
+					ch <- deviceEnergyDesc.metric(opts, d, prometheus.CounterValue, j)
+				}
+			}
+		}
+		if opts.enabled(FamilyMonitor) {
+			ch <- prometheus.MustNewConstMetric(
+				energyDesc,
+				prometheus.CounterValue,
+				t.Monitor,
+			)
+			ch <- prometheus.MustNewConstMetric(
+				unidentifiedEnergyDesc,
+				prometheus.CounterValue,
+				t.Unidentified,
+			)
+		}
+		if s.solar && opts.enabled(FamilySolar) {
+			ch <- prometheus.MustNewConstMetric(
+				solarEnergyDesc,
+				prometheus.CounterValue,
+				t.Solar,
+			)
+			ch <- prometheus.MustNewConstMetric(
+				gridImportEnergyDesc,
+				prometheus.CounterValue,
+				t.GridImport,
+			)
+			ch <- prometheus.MustNewConstMetric(
+				gridExportEnergyDesc,
+				prometheus.CounterValue,
+				t.GridExport,
+			)
+		}
+	}
+}
+
+// collectGroups emits metrics for each of Options.Groups, from all of the
+// devices in the group, whether or not they're exported themselves.
+func (s *snapshot) collectGroups(ch chan<- prometheus.Metric, opts *Options) {
+	for _, group := range slices.Sorted(maps.Keys(opts.Groups)) {
+		if msg := s.realtime; msg != nil {
+			var w float64
+			for _, rd := range msg.Devices {
+				if opts.inGroup(group, opts.device(s.devices, rd.ID)) {
+					w += float64(rd.W)
+				}
+			}
+			ch <- prometheus.MustNewConstMetric(
+				groupWattsDesc,
+				prometheus.GaugeValue,
+				w,
+				group,
+			)
+		}
+		if t := s.energy; t != nil && opts.enabled(FamilyEnergy) {
+			// This is the energy used by the group's current members,
+			// so changing the group can make it go backwards, which
+			// looks like a counter reset.
+			var j float64
+			for id, dj := range t.Devices {
+				if opts.inGroup(group, opts.device(s.devices, id)) {
+					j += dj
+				}
+			}
+			ch <- prometheus.MustNewConstMetric(
+				groupEnergyDesc,
+				prometheus.CounterValue,
+				j,
+				group,
+			)
+		}
+	}
+}
+
+// exportedDevices returns the IDs of the devices we should export metrics
+// for, and how many more there would have been if not for
+// Options.Devices.MaxPerMonitor.
+func (s *snapshot) exportedDevices(opts *Options) (map[string]bool, int) {
+	seen := make(map[string]bool)
+	for id := range s.devices {
+		seen[id] = true
+	}
+	if s.realtime != nil {
+		for _, d := range s.realtime.Devices {
+			seen[d.ID] = true
+		}
+	}
+	if s.states != nil {
+		for _, d := range s.states.States {
+			seen[d.DeviceID] = true
+		}
+	}
+	if s.energy != nil {
+		for id := range s.energy.Devices {
+			seen[id] = true
+		}
+		for id := range s.energy.ActiveSeconds {
+			seen[id] = true
+		}
+	}
+
+	var ids []string
+	for id := range seen {
+		if opts.includeDevice(opts.device(s.devices, id)) {
+			ids = append(ids, id)
+		}
+	}
+	dropped := 0
+	if limit := opts.Devices.MaxPerMonitor; limit > 0 && len(ids) > limit {
+		// Prefer devices Sense told us about, then go by ID.
+		slices.SortFunc(ids, func(a, b string) int {
+			_, aKnown := s.devices[a]
+			_, bKnown := s.devices[b]
+			if aKnown != bKnown {
+				if aKnown {
+					return -1
+				}
+				return 1
+			}
+			return strings.Compare(a, b)
+		})
+		dropped = len(ids) - limit
+		ids = ids[:limit]
+	}
+
+	exported := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		exported[id] = true
+	}
+	return exported, dropped
+}
+
+// imbalance computes the difference between the highest and lowest channel
+// power as a fraction of the total.  It is undefined unless there are at
+// least two channels drawing power.
+func imbalance(channels []float32) (float64, bool) {
+	if len(channels) < 2 {
+		return 0, false
+	}
+	lo, hi := float64(channels[0]), float64(channels[0])
+	var total float64
+	for _, w := range channels {
+		lo = min(lo, float64(w))
+		hi = max(hi, float64(w))
+		total += float64(w)
+	}
+	if total <= 0 {
+		return 0, false
+	}
+	return (hi - lo) / total, true
+}
+
+// callbackContainer captures the first RealtimeUpdate and DeviceStates
+// messages from a stream and then stops it.
+type callbackContainer struct {
+	snap snapshot
+}
+
+func (e *callbackContainer) callback(ctx context.Context, msg realtime.Message) error {
+	switch msg := msg.(type) {
+	case *realtime.RealtimeUpdate:
+		if e.snap.realtime == nil {
+			e.snap.realtime = msg
+		}
+	case *realtime.DeviceStates:
+		if e.snap.states == nil {
+			e.snap.states = msg
+		}
+	}
+
+	if e.snap.realtime != nil && e.snap.states != nil {
+		return realtime.Stop
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package exporter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dnesting/sense"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scrapeStats records how collections from a monitor have gone, along with
+// the last data collected.  Unlike a Collector, which may only last for a
+// single request, these are kept for as long as the Exporter knows about the
+// monitor.
+type scrapeStats struct {
+	mu          sync.Mutex
+	errors      map[[2]string]int // by stage, reason
+	lastSuccess time.Time
+	lastSnap    *snapshot
+	lastSnapAt  time.Time
+	devices     deviceHistory
+}
+
+func newScrapeStats() *scrapeStats {
+	return &scrapeStats{errors: make(map[[2]string]int)}
+}
+
+// failed records an error from the given stage of a collection.
+func (st *scrapeStats) failed(stage string, err error) {
+	reason := errorReason(err)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.errors[[2]string{stage, reason}]++
+}
+
+// succeeded records a successful collection.
+func (st *scrapeStats) succeeded(t time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.lastSuccess = t
+}
+
+// remember holds on to snap, received at t, in case we need it later.
+func (st *scrapeStats) remember(snap snapshot, t time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.lastSnap = &snap
+	st.lastSnapAt = t
+}
+
+// lastSnapshot returns the data passed to remember, and when it was received.
+func (st *scrapeStats) lastSnapshot() (snapshot, time.Time, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.lastSnap == nil {
+		return snapshot{}, time.Time{}, false
+	}
+	return *st.lastSnap, st.lastSnapAt, true
+}
+
+// sawDevices records the device list just fetched from the monitor, and
+// returns when we first saw each device.
+func (st *scrapeStats) sawDevices(monitor int, devices map[string]sense.Device) map[string]time.Time {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.devices.update(monitor, devices, time.Now())
+}
+
+// saveHistory returns the device history in a form that can be persisted,
+// or nil if there isn't any.
+func (st *scrapeStats) saveHistory() *savedHistory {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.devices.save()
+}
+
+// restoreHistory replaces the device history with one saved earlier.
+func (st *scrapeStats) restoreHistory(sh *savedHistory) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.devices.restore(sh)
+}
+
+func (st *scrapeStats) collect(ch chan<- prometheus.Metric) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, stage := range errorStages {
+		for _, reason := range errorReasons {
+			ch <- prometheus.MustNewConstMetric(
+				scrapeErrorsDesc,
+				prometheus.CounterValue,
+				float64(st.errors[[2]string{stage, reason}]),
+				stage, reason,
+			)
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(
+		devicesDiscoveredDesc,
+		prometheus.CounterValue,
+		float64(st.devices.discovered),
+	)
+	ch <- prometheus.MustNewConstMetric(
+		devicesRenamedDesc,
+		prometheus.CounterValue,
+		float64(st.devices.renamed),
+	)
+	ch <- prometheus.MustNewConstMetric(
+		devicesRemovedDesc,
+		prometheus.CounterValue,
+		float64(st.devices.removed),
+	)
+	if !st.lastSuccess.IsZero() {
+		ch <- prometheus.MustNewConstMetric(
+			lastSuccessDesc,
+			prometheus.GaugeValue,
+			float64(st.lastSuccess.UnixNano())/1e9,
+		)
+	}
+}
+
+// monitorStats returns the stats for the given monitor.  e.mu must be held.
+func (e *Exporter) monitorStats(k monitorKey) *scrapeStats {
+	st, ok := e.stats[k]
+	if !ok {
+		st = newScrapeStats()
+		e.stats[k] = st
+	}
+	return st
+}
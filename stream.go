@@ -0,0 +1,274 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dnesting/sense/realtime"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+
+	// deviceRefreshInterval limits how often we re-fetch the device list
+	// when the stream reports a device we don't know about.
+	deviceRefreshInterval = time.Minute
+)
+
+var errStreamClosed = errors.New("stream closed by server")
+
+// Stream maintains a persistent realtime connection to a single Sense monitor,
+// reconnecting with backoff as needed, and keeps the most recent data it has
+// received in memory.
+type Stream struct {
+	cl      Client
+	monitor int
+	stop    context.CancelFunc  // set by Exporter
+	onAuth  func(Client, error) // set by Exporter
+	stats   *scrapeStats
+	now     func() time.Time // when messages are received
+
+	mu             sync.Mutex
+	timeout        time.Duration
+	snap           snapshot
+	connected      bool
+	devicesFetched time.Time
+	energy         *energyTotals
+	lastUpdate     time.Time // for energy; zero while disconnected
+	activity       activity
+	updated        time.Time // when snap.realtime was received
+	includeMerged  bool      // set by Exporter
+}
+
+// NewStream creates a Stream for the specified monitor.  The timeout applies
+// to fetching the device list and bounds how long the stream may go without
+// receiving a message before we reconnect.
+func NewStream(client Client, monitorID int, timeout time.Duration) *Stream {
+	return &Stream{
+		cl:      client,
+		monitor: monitorID,
+		timeout: timeout,
+		snap:    snapshot{solar: solarConfigured(client, monitorID)},
+		energy:  newEnergyTotals(),
+		stats:   newScrapeStats(),
+		now:     time.Now,
+	}
+}
+
+// latest returns the most recent data received from the monitor, when it
+// was received, and whether the stream is currently connected.
+func (s *Stream) latest() (snapshot, time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := s.snap
+	snap.energy = s.energy.clone()
+	return snap, s.updated, s.connected
+}
+
+// energyTotals returns a copy of the energy measured so far.
+func (s *Stream) energyTotals() *energyTotals {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.energy.clone()
+}
+
+// Run connects to the monitor and keeps the connection open until ctx is
+// canceled.
+func (s *Stream) Run(ctx context.Context) {
+	backoff := minBackoff
+	for {
+		start := time.Now()
+		received, err := s.connect(ctx)
+		s.setConnected(false)
+		if ctx.Err() != nil {
+			return
+		}
+		if received {
+			// The connection worked, so start over.
+			backoff = minBackoff
+		}
+		wait := backoff
+		if received && err == errStreamClosed && time.Since(start) > minBackoff {
+			// Sense closes working streams from time to time.  We don't
+			// integrate energy across the gap, so keep it short.
+			wait = 0
+		}
+		log.Printf("stream for monitor %d: %v (reconnecting in %s)", s.monitor, err, wait)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if wait > 0 {
+			backoff = min(backoff*2, maxBackoff)
+		}
+	}
+}
+
+// connect streams from the monitor until the stream ends, reporting whether
+// we received anything.
+func (s *Stream) connect(parent context.Context) (bool, error) {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	if err := s.refreshDevices(ctx); err != nil {
+		return false, err
+	}
+	log.Println("streaming from monitor", s.monitor)
+
+	// Reconnect if the stream goes quiet for too long.
+	var watchdog *time.Timer
+	if timeout := s.currentTimeout(); timeout > 0 {
+		watchdog = time.AfterFunc(timeout, cancel)
+		defer watchdog.Stop()
+	}
+	var received atomic.Bool
+	err := s.cl.Stream(ctx, s.monitor, func(ctx context.Context, msg realtime.Message) error {
+		if timeout := s.currentTimeout(); watchdog != nil && timeout > 0 {
+			watchdog.Reset(timeout)
+		}
+		received.Store(true)
+		s.callback(ctx, msg)
+		return nil
+	})
+	switch {
+	case parent.Err() != nil:
+		// We're shutting down.
+		return received.Load(), err
+	case ctx.Err() != nil:
+		err = errStreamTimeout
+	case err == nil:
+		// Sense closes streams from time to time.  That's not a failure
+		// to collect anything, so we just reconnect.
+		return received.Load(), errStreamClosed
+	default:
+		s.authResult(err)
+	}
+	s.stats.failed(stageStream, err)
+	return received.Load(), err
+}
+
+func (s *Stream) refreshDevices(ctx context.Context) error {
+	ctx, span := otel.Tracer(traceName).Start(ctx, "Fetch devices from Sense Monitor "+strconv.Itoa(s.monitor))
+	defer span.End()
+	span.SetAttributes(attribute.Int("sense-userid", s.cl.GetUserID()))
+	span.SetAttributes(attribute.Int("sense-account", s.cl.GetAccountID()))
+	span.SetAttributes(attribute.Int("sense-monitor", s.monitor))
+	if timeout := s.currentTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	s.mu.Lock()
+	s.devicesFetched = time.Now()
+	includeMerged := s.includeMerged
+	s.mu.Unlock()
+
+	devices, err := s.cl.GetDevices(ctx, s.monitor, includeMerged)
+	s.authResult(err)
+	if err != nil {
+		span.RecordError(err)
+		if ctx.Err() == nil || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			s.stats.failed(stageDevices, err)
+		}
+		return err
+	}
+
+	devMap := deviceMap(devices)
+	firstSeen := s.stats.sawDevices(s.monitor, devMap)
+	s.mu.Lock()
+	s.snap.devices = devMap
+	s.snap.firstSeen = firstSeen
+	s.mu.Unlock()
+	return nil
+}
+
+// authResult tells the Exporter, if any, how a call to Sense went.
+func (s *Stream) authResult(err error) {
+	if s.onAuth != nil {
+		s.onAuth(s.cl, err)
+	}
+}
+
+// currentTimeout returns the timeout for fetching the device list and for
+// the stream going quiet.
+func (s *Stream) currentTimeout() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.timeout
+}
+
+func (s *Stream) setTimeout(timeout time.Duration) {
+	s.mu.Lock()
+	s.timeout = timeout
+	s.mu.Unlock()
+}
+
+func (s *Stream) setIncludeMerged(includeMerged bool) {
+	s.mu.Lock()
+	s.includeMerged = includeMerged
+	s.mu.Unlock()
+}
+
+func (s *Stream) setConnected(connected bool) {
+	s.mu.Lock()
+	s.connected = connected
+	if !connected {
+		// Don't integrate power across the time we were disconnected.
+		s.lastUpdate = time.Time{}
+		s.activity.disconnected()
+	}
+	s.mu.Unlock()
+}
+
+func (s *Stream) callback(ctx context.Context, msg realtime.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.activity.update(msg, now, s.energy)
+	switch msg := msg.(type) {
+	case *realtime.RealtimeUpdate:
+		if prev := s.snap.realtime; prev != nil && !s.lastUpdate.IsZero() {
+			// Attribute the previous reading to the time since we received it.
+			if dt := now.Sub(s.lastUpdate); dt <= maxEnergyGap {
+				s.energy.add(prev, dt)
+			}
+		}
+		s.lastUpdate = now
+		s.updated = now
+		s.snap.realtime = msg
+		s.connected = true
+		s.stats.succeeded(now)
+		if s.hasUnknownDevice(msg.Devices) && time.Since(s.devicesFetched) > deviceRefreshInterval {
+			s.devicesFetched = time.Now()
+			go func() {
+				if err := s.refreshDevices(ctx); err != nil {
+					log.Printf("refreshing devices for monitor %d: %v", s.monitor, err)
+				}
+			}()
+		}
+	case *realtime.DeviceStates:
+		s.snap.states = msg
+	}
+}
+
+// hasUnknownDevice reports whether any of devices is missing from our device
+// list, which probably means Sense has detected something new.
+func (s *Stream) hasUnknownDevice(devices []realtime.Device) bool {
+	for _, d := range devices {
+		if _, ok := s.snap.devices[d.ID]; !ok {
+			return true
+		}
+	}
+	return false
+}